@@ -6,20 +6,17 @@ if [ "$EUID" -ne 0 ]; then
     exit 1
 fi
 
-# Read station number from /etc/iceslab/iceslab.conf
-STATION_NUM=$(grep "station_number=" /etc/iceslab/iceslab.conf | cut -d'=' -f2)
+# Read station number from the iceslab config
+STATION_NUM=$(/opt/iceslab/iceslab config get station_id)
 if test -z "$STATION_NUM"; then
-    echo "Station number not found in /etc/iceslab/iceslab.conf. Please enter (e.g., 01): "
+    echo "Station number not found in iceslab config. Please enter (e.g., 01): "
     read STATION_NUM
     STATION_NUM=$(echo "$STATION_NUM" | xargs) # Trim whitespace
-    # Update /etc/iceslab/iceslab.conf with station number
-    sudo tee -a /etc/iceslab/iceslab.conf > /dev/null <<EOF
-        [ID]
-        station_number=$STATION_NUM
-        EOF
 fi
 
-sudo hostnamectl set-hostname "iceslab-$STATION_NUM"
+# Validate the ID, save it and set the hostname from it
+/opt/iceslab/iceslab station set "$STATION_NUM" || exit 1
+STATION_NUM=$(/opt/iceslab/iceslab config get station_id)
 
 sudo -i -u $SUDO_USER <<EOF
 
@@ -3,4 +3,4 @@
 # Mute audio
 wpctl set-mute @DEFAULT_AUDIO_SINK@ 1
 
-sudo /opt/iceslab/iceslab -u b
+sudo /opt/iceslab/iceslab -log journald update bookmarks
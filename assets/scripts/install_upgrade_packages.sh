@@ -65,6 +65,9 @@ dnf install -y cabextract xorg-x11-font-utils fontconfig
 rpm -i --nodigest --nosignature https://downloads.sourceforge.net/project/mscorefonts2/rpms/msttcore-fonts-installer-2.6-1.noarch.rpm
 fc-cache -fv
 
-touch .post_install
+/opt/iceslab/iceslab config set post_install_complete true
 
-reboot
\ No newline at end of file
+# Unattended installs pass --no-reboot and let iceslab decide
+if [ "$1" != "--no-reboot" ]; then
+    reboot
+fi
@@ -8,11 +8,11 @@ if [ "$EUID" -ne 0 ]; then
 fi
 
 # Check if post-install has already been completed
-POST_INSTALL_COMPLETE=$(grep "post_install_complete=true" /etc/iceslab/iceslab.conf &>/dev/null)
-STATION_NUMBER=$(grep "station_number=" /etc/iceslab/iceslab.conf | cut -d'=' -f2)
+POST_INSTALL_COMPLETE=$(/opt/iceslab/iceslab config get post_install_complete)
+STATION_NUMBER=$(/opt/iceslab/iceslab config get station_id)
 
 # If both are found, exit script
-if [[ $? -eq 0 && -n "$STATION_NUMBER" ]]; then
+if [[ "$POST_INSTALL_COMPLETE" == "true" && -n "$STATION_NUMBER" ]]; then
     echo "Post-install already completed for Station $STATION_NUMBER. Exiting."
     exit 0
 fi
@@ -78,12 +78,6 @@ dnf install -y cabextract xorg-x11-font-utils fontconfig
 rpm -i --nodigest --nosignature https://downloads.sourceforge.net/project/mscorefonts2/rpms/msttcore-fonts-installer-2.6-1.noarch.rpm
 fc-cache -fv
 
-# Mark post_install_complete in /etc/iceslab/iceslab.conf
-mkdir -p /etc/iceslab
-tee /etc/iceslab/iceslab.conf > /dev/null <<EOF
-[Setup]
-post_install_complete=true
-
-[ID]
-station_number=$STATION_NUM
-EOF
\ No newline at end of file
+# Mark post_install_complete in the iceslab config
+/opt/iceslab/iceslab config set station_id "$STATION_NUM"
+/opt/iceslab/iceslab config set post_install_complete true
@@ -0,0 +1,999 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"iceslab/utils"
+
+	"github.com/rs/zerolog/log"
+	"go.yaml.in/yaml/v4"
+)
+
+// version and commit are set at build time with -ldflags "-X main.version=... -X main.commit=...".
+// Without commit, the VCS revision Go stamps into the build is used.
+var (
+	version = "dev"
+	commit  = ""
+)
+
+func buildCommit() string {
+	if commit != "" {
+		return commit
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" {
+				return setting.Value
+			}
+		}
+	}
+	return ""
+}
+
+// command is a node in the CLI tree. Leaves set Setup, which registers the command's
+// flags and returns the function that runs it with the remaining positional args.
+type command struct {
+	Name        string
+	Usage       string
+	Summary     string
+	Setup       func(fs *flag.FlagSet) func(args []string) error
+	Subcommands []*command
+}
+
+var rootCommand *command
+
+// dryRunFlag is shared by the global flag set and every command's flag set, so
+// --dry-run works before or after the command name.
+var dryRunFlag bool
+
+const dryRunUsage = "Print the planned changes without executing anything"
+
+func init() {
+	rootCommand = &command{
+		Name:    "iceslab",
+		Usage:   "[-v] <command>",
+		Summary: "Provision and maintain iceslab lab stations",
+		Subcommands: []*command{
+			{Name: "install", Summary: "Install to <root>/opt/iceslab/ and run setup scripts", Setup: setupInstall},
+			{Name: "uninstall", Summary: "Revert everything install created or modified", Setup: setupUninstall},
+			{Name: "update", Summary: "Update source or bookmarks from GitHub", Subcommands: []*command{
+				{Name: "source", Summary: "Download and unpack the channel's source", Setup: setupUpdateSource},
+				{Name: "bookmarks", Summary: "Fetch the latest inventory and bookmarks and apply them", Setup: setupUpdateBookmarks},
+				{Name: "self", Summary: "Replace the installed binary with the channel's release", Setup: setupUpdateSelf},
+				{Name: "check", Summary: "Report what each channel would install, without installing", Setup: setupUpdateCheck},
+			}},
+			{Name: "agent", Summary: "Refresh bookmarks (and optionally the binary) in the background", Subcommands: []*command{
+				{Name: "run", Summary: "Run one background update, unless in quiet hours or another update is running", Setup: setupAgentRun},
+				{Name: "install", Summary: "Write and enable the " + utils.UpdateUnit + " service and timer from the agent config", Setup: setupAgentInstall},
+			}},
+			{Name: "bookmarks", Summary: "Inspect and apply bookmarks", Subcommands: []*command{
+				{Name: "list", Summary: "List the bookmarks this station would receive", Setup: setupBookmarksList},
+				{Name: "apply", Summary: "Write bookmarks and network settings into the browser policies", Setup: setupBookmarksApply},
+			}},
+			{Name: "station", Summary: "Show and change this station's identity", Subcommands: []*command{
+				{Name: "show", Summary: "Show the station ID, hostname and inventory entry", Setup: setupStationShow},
+				{Name: "set", Usage: "<id>", Summary: "Validate and save the station ID and set the hostname", Setup: setupStationSet},
+				{Name: "clear", Summary: "Remove the station ID from the config", Setup: setupStationClear},
+				{Name: "list", Summary: "List stations from the inventory", Setup: setupStationList},
+			}},
+			{Name: "manifest", Summary: "Work with the per-file asset manifest", Subcommands: []*command{
+				{Name: "generate", Summary: "Write a manifest of the embedded assets (or -dir)", Setup: setupManifestGenerate},
+			}},
+			{Name: "verify", Summary: "Report installed assets that are missing, modified or extra", Setup: setupVerify},
+			{Name: "mirror", Summary: "Maintain an offline or LAN update mirror", Subcommands: []*command{
+				{Name: "sync", Usage: "<dir>", Summary: "Download current releases, bookmarks and inventory into <dir>", Setup: setupMirrorSync},
+			}},
+			{Name: "serve", Summary: "Run the lab controller: a synced mirror, rollout reports and an API, for stations' update_url", Setup: setupServe},
+			{Name: "version", Summary: "Print the version and platform", Setup: setupVersion},
+			{Name: "status", Summary: "Report this station's state (-json for scripts)", Setup: setupStatus},
+			{Name: "doctor", Summary: "Run pre-session health checks", Setup: setupDoctor},
+			{Name: "assets", Summary: "Work with the embedded assets", Subcommands: []*command{
+				{Name: "dump", Summary: "Write the embedded assets to disk", Setup: setupAssetsDump},
+			}},
+			{Name: "config", Summary: "Read and write the station config", Subcommands: []*command{
+				{Name: "get", Usage: "<key>", Summary: "Print a config value", Setup: setupConfigGet},
+				{Name: "set", Usage: "<key> <value>", Summary: "Change a config value", Setup: setupConfigSet},
+			}},
+		},
+	}
+}
+
+func (c *command) execute(path string, args []string) error {
+	if len(c.Subcommands) > 0 {
+		if len(args) == 0 {
+			printCommandHelp(os.Stderr, c, path, nil)
+			return usageErrorf("%s requires a subcommand", path)
+		}
+		if args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+			printCommandHelp(os.Stdout, c, path, nil)
+			return nil
+		}
+		for _, sub := range c.Subcommands {
+			if sub.Name == args[0] {
+				return sub.execute(path+" "+sub.Name, args[1:])
+			}
+		}
+		printCommandHelp(os.Stderr, c, path, nil)
+		return usageErrorf("unknown command %q for %s", args[0], path)
+	}
+
+	fs := flag.NewFlagSet(path, flag.ContinueOnError)
+	fs.BoolVar(&dryRunFlag, "dry-run", dryRunFlag, dryRunUsage)
+	runFn := c.Setup(fs)
+	fs.Usage = func() { printCommandHelp(os.Stderr, c, path, fs) }
+	positional, err := parseInterspersed(fs, args)
+	if errors.Is(err, flag.ErrHelp) {
+		return nil
+	}
+	if err != nil {
+		return usageError{err}
+	}
+	utils.SetDryRun(dryRunFlag)
+	utils.SetLogField("command", strings.TrimPrefix(path, rootCommand.Name+" "))
+	return runFn(positional)
+}
+
+// parseInterspersed lets flags follow positional arguments, e.g. "station set 07 -no-hostname".
+func parseInterspersed(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		err := fs.Parse(args)
+		if err != nil {
+			return nil, err
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+func printCommandHelp(w io.Writer, c *command, path string, fs *flag.FlagSet) {
+	usage := path + " [flags] " + c.Usage
+	switch {
+	case c == rootCommand:
+		usage = path + " " + c.Usage
+	case len(c.Subcommands) > 0:
+		usage = path + " <command>"
+	}
+	fmt.Fprintf(w, "Usage: %s\n\n%s\n", usage, c.Summary)
+
+	if len(c.Subcommands) > 0 {
+		fmt.Fprintln(w, "\nCommands:")
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		for _, sub := range c.Subcommands {
+			fmt.Fprintf(tw, "  %s\t%s\n", sub.Name, sub.Summary)
+		}
+		tw.Flush()
+		fmt.Fprintf(w, "\nRun '%s <command> -h' for help on a command.\n", path)
+	}
+
+	if fs != nil {
+		hasFlags := false
+		fs.VisitAll(func(*flag.Flag) { hasFlags = true })
+		if hasFlags {
+			fmt.Fprintln(w, "\nFlags:")
+			fs.SetOutput(w)
+			fs.PrintDefaults()
+		}
+	}
+}
+
+func joinArgs(args []string) string {
+	return strings.Join(args, " ")
+}
+
+func noArgs(run func() error) func(args []string) error {
+	return func(args []string) error {
+		if len(args) != 0 {
+			return usageErrorf("unexpected arguments: %s", joinArgs(args))
+		}
+		return run()
+	}
+}
+
+// requireStation runs the admin user check and resolves the station ID for commands
+// that change the station.
+func requireStation() (string, error) {
+	err := utils.CheckIfCorrectUser()
+	if err != nil {
+		return "", fmt.Errorf("user check failed: %w", err)
+	}
+	stationID, err := utils.GetStationID()
+	if err != nil {
+		return "", fmt.Errorf("failed to get station ID: %w", err)
+	}
+	return stationID, nil
+}
+
+// updateStation resolves the station ID for the update commands. Login units and
+// scripts run those without a terminal and as whichever user the unit runs as, so
+// the admin user check, which only guards against running from the wrong account by
+// mistake, is left to interactive runs.
+func updateStation() (string, error) {
+	if utils.Interactive() {
+		return requireStation()
+	}
+	stationID, err := utils.GetStationID()
+	if err != nil {
+		return "", fmt.Errorf("failed to get station ID: %w", err)
+	}
+	return stationID, nil
+}
+
+func setupInstall(fs *flag.FlagSet) func(args []string) error {
+	answersPath := fs.String("answers", "", "Answer file for a non-interactive install (station ID, admin user, steps, reboot)")
+	return noArgs(func() error {
+		err := utils.StartInstallRecord()
+		if err != nil {
+			return fmt.Errorf("failed to start install record: %w", err)
+		}
+
+		var answers *utils.Answers
+		var stationID string
+		if *answersPath != "" {
+			var loaded utils.Answers
+			loaded, err = utils.LoadAnswers(*answersPath)
+			if err != nil {
+				return err
+			}
+			answers = &loaded
+			stationID, err = applyAnswers(loaded)
+		} else {
+			stationID, err = requireStation()
+		}
+		if err != nil {
+			return err
+		}
+
+		runs := func(step string) bool { return answers == nil || answers.Runs(step) }
+
+		paths := utils.CurrentPaths()
+		log.Info().Str("installPath", paths.InstallDir).Msg("Installing iceslab to path")
+
+		execPath, err := os.Executable()
+		if err != nil {
+			return fmt.Errorf("failed to get executable path: %w", err)
+		}
+
+		if execPath != paths.Binary {
+			log.Warn().Str("execPath", execPath).Str("installPath", paths.InstallDir).Msg("Executable is not running from install path; moving it there")
+			err = utils.InstallTo(paths.InstallDir)
+			if err != nil {
+				return fmt.Errorf("failed to install to path: %w", err)
+			}
+			// Re-run the program from the new location with same arguments. A dry run
+			// carries on planning as if it already had.
+			if !utils.DryRun() {
+				return utils.RerunBinary(paths.Binary, os.Args[1:]...)
+			}
+		}
+
+		err = utils.DumpAssets(embedded, "assets", paths.Assets)
+		if err != nil {
+			return fmt.Errorf("failed to dump assets in installPath: %w", err)
+		}
+		manifest, err := embeddedManifest()
+		if err != nil {
+			return err
+		}
+		err = utils.SaveManifest(manifest, paths.Manifest)
+		if err != nil {
+			return fmt.Errorf("failed to save manifest: %w", err)
+		}
+
+		if runs(utils.StepPackages) {
+			err = utils.InstallPackages(paths.InstallDir, answers != nil)
+			if err != nil {
+				return fmt.Errorf("failed to install packages: %w", err)
+			}
+		}
+
+		if runs(utils.StepGuestUser) {
+			err = utils.SetupGuestUser(paths.InstallDir)
+			if err != nil {
+				return fmt.Errorf("failed to set up guest user: %w", err)
+			}
+		}
+
+		if runs(utils.StepBookmarks) {
+			err = utils.InsertBookmarksInPolicies(stationID)
+			if err != nil {
+				return fmt.Errorf("failed to install bookmarks: %w", err)
+			}
+
+			err = utils.InsertNetworkInPolicies()
+			if err != nil {
+				return fmt.Errorf("failed to install browser network settings: %w", err)
+			}
+		}
+
+		if runs(utils.StepPolicies) {
+			err = utils.CopyDirectoryTo(paths.PoliciesSource, paths.Etc)
+			if err != nil {
+				return fmt.Errorf("failed to copy %s to %s: %w", paths.PoliciesSource, paths.Etc, err)
+			}
+		}
+
+		if answers != nil && *answers.Reboot {
+			log.Info().Msg("Installation completed successfully. Rebooting system to apply changes.")
+			return utils.RunShellCommand("systemctl reboot")
+		}
+		log.Info().Msg("Installation completed successfully")
+		return nil
+	})
+}
+
+// applyAnswers checks the user and saves the station ID from an answer file without prompting.
+func applyAnswers(answers utils.Answers) (string, error) {
+	err := utils.RequireUser(answers.AdminUser)
+	if err != nil {
+		return "", fmt.Errorf("user check failed: %w", err)
+	}
+	var cfg utils.Config
+	err = utils.UpdateConfig(func(c *utils.Config) error {
+		err := c.Set("station_id", answers.StationID)
+		cfg = *c
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to save station ID from answer file: %w", err)
+	}
+	log.Info().Str("station_id", cfg.StationID).Strs("steps", answers.Steps).Msg("Using answer file")
+	return cfg.StationID, nil
+}
+
+func setupUninstall(fs *flag.FlagSet) func(args []string) error {
+	force := fs.Bool("force", false, "Also remove installed files that were changed since install")
+	return noArgs(func() error {
+		err := utils.CheckIfCorrectUser()
+		if err != nil {
+			return fmt.Errorf("user check failed: %w", err)
+		}
+		return utils.Uninstall(*force)
+	})
+}
+
+const channelUsage = "Channel for this run: stable, beta, a release tag or a commit (default from the config)"
+
+// newClient uses the GitHub token if one is set. A token file that others can read
+// is ignored rather than failing the run, so stations keep updating anonymously.
+func newClient() *utils.Client {
+	token, err := utils.GitHubToken()
+	if err != nil {
+		log.Warn().Err(err).Msg("Ignoring GitHub token")
+	}
+	return utils.NewClient(runContext, token)
+}
+
+// channelFor returns the -channel override if set, else the channel from the config.
+func channelFor(override string, configured func(utils.Channels) string) (string, error) {
+	if override != "" {
+		return override, utils.ValidateChannel(override)
+	}
+	cfg, err := utils.LoadConfig()
+	if err != nil {
+		return "", err
+	}
+	return configured(cfg.Channel), nil
+}
+
+func binaryChannel(c utils.Channels) string    { return c.Binary }
+func bookmarksChannel(c utils.Channels) string { return c.Bookmarks }
+
+func setupUpdateSource(fs *flag.FlagSet) func(args []string) error {
+	channelFlag := fs.String("channel", "", channelUsage)
+	return noArgs(func() error {
+		_, err := updateStation()
+		if err != nil {
+			return err
+		}
+		channel, err := channelFor(*channelFlag, binaryChannel)
+		if err != nil {
+			return usageError{err}
+		}
+		unlock, err := utils.LockUpdates(runContext, true)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+		log.Info().Msg("Updating source code")
+		client := newClient()
+		err = client.UpdateSource(channel)
+		if err != nil {
+			return fmt.Errorf("failed to update source code: %w", err)
+		}
+		return nil
+	})
+}
+
+func setupUpdateBookmarks(fs *flag.FlagSet) func(args []string) error {
+	channelFlag := fs.String("channel", "", channelUsage)
+	return noArgs(func() error {
+		stationID, err := updateStation()
+		if err != nil {
+			return err
+		}
+		channel, err := channelFor(*channelFlag, bookmarksChannel)
+		if err != nil {
+			return usageError{err}
+		}
+		// Waits for a running agent, so the session starts with what it fetched
+		unlock, err := utils.LockUpdates(runContext, true)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+		return refreshBookmarks(newClient(), channel, stationID)
+	})
+}
+
+// refreshBookmarks fetches the inventory and bookmarks for the channel and applies
+// them. Fetch failures are not fatal: the station still applies what it already has.
+// Under a staged rollout, a new bundle may be held back, and how applying it went is
+// reported for the stations that come after.
+func refreshBookmarks(client *utils.Client, channel, stationID string) error {
+	resolution := utils.ResolveBookmarksChannel(channel)
+	candidate := client.BookmarksCandidate(resolution)
+	if candidate != nil && client.HoldRollout(*candidate, stationID) {
+		_, err := applyBookmarks(stationID)
+		return err
+	}
+
+	log.Info().Str("channel", resolution.Channel).Str("ref", resolution.Ref).Msg("Updating bookmarks")
+	inventoryErr := client.UpdateInventory(resolution)
+	if inventoryErr != nil {
+		log.Err(inventoryErr).Msg("Failed to update inventory")
+	}
+	bookmarksErr := client.UpdateBookmarkYamls(resolution)
+	if bookmarksErr != nil {
+		log.Err(bookmarksErr).Msg("Failed to update bookmarks")
+	}
+	problems, err := applyBookmarks(stationID)
+	if candidate != nil {
+		client.ReportRollout(*candidate, stationID, errors.Join(inventoryErr, bookmarksErr, problems, err))
+	}
+	return err
+}
+
+func setupUpdateSelf(fs *flag.FlagSet) func(args []string) error {
+	rollback := fs.Bool("rollback", false, "Restore the binary replaced by the last update")
+	channelFlag := fs.String("channel", "", channelUsage)
+	checkRoot := fs.String("check-root", "", "Check that this binary starts under the given install root and exit; update self runs it on the new binary")
+	return noArgs(func() error {
+		if *checkRoot != "" {
+			// The update that runs this holds the lock and has checked the user
+			err := utils.CheckStart(*checkRoot)
+			if err != nil {
+				return err
+			}
+			fmt.Println(version)
+			return nil
+		}
+		err := utils.CheckIfCorrectUser()
+		if err != nil {
+			return err
+		}
+		unlock, err := utils.LockUpdates(runContext, true)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+		if *rollback {
+			return utils.RollbackSelf()
+		}
+		channel, err := channelFor(*channelFlag, binaryChannel)
+		if err != nil {
+			return usageError{err}
+		}
+		log.Info().Str("version", version).Str("asset", utils.SelfAssetName()).Msg("Updating binary")
+		client := newClient()
+		err = client.UpdateSelf(channel)
+		if err != nil {
+			return fmt.Errorf("failed to update binary: %w", err)
+		}
+		return nil
+	})
+}
+
+// setupAgentRun is what the update timer runs. It never prompts, and it skips the
+// run rather than waiting when quiet hours apply or another update holds the lock.
+func setupAgentRun(fs *flag.FlagSet) func(args []string) error {
+	force := fs.Bool("force", false, "Run even during quiet hours")
+	return noArgs(func() error {
+		cfg, err := utils.LoadConfig()
+		if err != nil {
+			return err
+		}
+		quiet, err := cfg.Agent.InQuietHours(time.Now())
+		if err != nil {
+			return fmt.Errorf("agent.quiet_hours: %w", err)
+		}
+		if quiet && !*force {
+			log.Info().Str("quiet_hours", cfg.Agent.QuietHours).Msg("Within quiet hours; skipping update")
+			return nil
+		}
+		unlock, err := utils.LockUpdates(runContext, false)
+		if errors.Is(err, utils.ErrUpdateLocked) {
+			log.Info().Msg("Another update is running; skipping this one")
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		defer unlock()
+
+		stationID, err := utils.GetStationID()
+		if err != nil {
+			return fmt.Errorf("failed to get station ID: %w", err)
+		}
+		client := newClient()
+		err = refreshBookmarks(client, cfg.Channel.Bookmarks, stationID)
+		if err != nil {
+			return err
+		}
+		if cfg.Agent.UpdateBinary {
+			err = client.UpdateSelf(cfg.Channel.Binary)
+			if err != nil {
+				return fmt.Errorf("failed to update binary: %w", err)
+			}
+		}
+		return nil
+	})
+}
+
+func setupAgentInstall(fs *flag.FlagSet) func(args []string) error {
+	return noArgs(func() error {
+		err := utils.CheckIfCorrectUser()
+		if err != nil {
+			return err
+		}
+		cfg, err := utils.LoadConfig()
+		if err != nil {
+			return err
+		}
+		// Continue the install record, so uninstall removes the units too
+		err = utils.StartInstallRecord()
+		if err != nil {
+			return fmt.Errorf("failed to start install record: %w", err)
+		}
+		return utils.InstallAgent(cfg.Agent)
+	})
+}
+
+func setupUpdateCheck(fs *flag.FlagSet) func(args []string) error {
+	asJSON := fs.Bool("json", false, "Print the report as JSON")
+	return noArgs(func() error {
+		if *asJSON {
+			logToStderr()
+		}
+		cfg, err := utils.LoadConfig()
+		if err != nil {
+			return err
+		}
+		checks := newClient().CheckUpdates(version, cfg.Channel)
+		if *asJSON {
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			return encoder.Encode(checks)
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "COMPONENT\tCHANNEL\tINSTALLED\tAVAILABLE\tPENDING")
+		for _, check := range checks {
+			available, pending := check.Available.Ref, "no"
+			if check.Pending {
+				pending = "yes"
+			}
+			if check.Error != "" {
+				available, pending = "error: "+check.Error, "-"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", check.Component, check.Available.Channel, orDash(check.Installed), orDash(available), pending)
+		}
+		return tw.Flush()
+	})
+}
+
+func setupMirrorSync(fs *flag.FlagSet) func(args []string) error {
+	refs := fs.String("refs", "", "Comma-separated extra release tags or commits to mirror, e.g. for pinned stations")
+	return func(args []string) error {
+		if len(args) != 1 {
+			return usageErrorf("mirror sync takes one directory")
+		}
+		return newClient().MirrorSync(args[0], splitRefs(*refs), "")
+	}
+}
+
+func splitRefs(refs string) []string {
+	var split []string
+	for _, ref := range strings.Split(refs, ",") {
+		if ref = strings.TrimSpace(ref); ref != "" {
+			split = append(split, ref)
+		}
+	}
+	return split
+}
+
+func setupServe(fs *flag.FlagSet) func(args []string) error {
+	addr := fs.String("addr", ":8080", "Address to listen on")
+	dir := fs.String("dir", "", "Mirror directory (default <root>/var/lib/iceslab/mirror)")
+	reports := fs.String("reports", "", "Rollout report directory (default <root>/var/lib/iceslab/reports)")
+	upstream := fs.String("upstream", "", "Where to sync from: another mirror or a GitHub fork (default GitHub)")
+	interval := fs.Duration("interval", 15*time.Minute, "How often to sync from upstream")
+	refs := fs.String("refs", "", "Comma-separated extra release tags or commits to mirror, e.g. for pinned stations")
+	pin := fs.String("pin", "", "Release tag the stable and beta channels resolve to, e.g. v1.4.0")
+	hold := fs.Bool("hold", false, "Start with upstream syncs paused")
+	return noArgs(func() error {
+		if utils.DryRun() {
+			return usageErrorf("serve does not support --dry-run")
+		}
+		if *interval < time.Minute {
+			return usageErrorf("-interval must be at least 1m, got %s", *interval)
+		}
+		paths := utils.CurrentPaths()
+		if *dir == "" {
+			*dir = paths.ServeDir
+		}
+		if *reports == "" {
+			*reports = paths.ServeReports
+		}
+		token, err := utils.GitHubToken()
+		if err != nil {
+			log.Warn().Err(err).Msg("Ignoring GitHub token")
+		}
+		// An unusable secret file leaves its routes open to this machine only
+		serveToken, err := utils.ServeToken()
+		if err != nil {
+			log.Warn().Err(err).Msg("Ignoring serve token")
+		}
+		reportSecret, err := utils.ReportSecret()
+		if err != nil {
+			log.Warn().Err(err).Msg("Ignoring report secret")
+		}
+		return utils.Serve(runContext, token, utils.ServeConfig{
+			Addr:     *addr,
+			Dir:      *dir,
+			Reports:  *reports,
+			Upstream: *upstream,
+			Interval: *interval,
+			Refs:     splitRefs(*refs),
+			Pin:      *pin,
+			Hold:     *hold,
+
+			Token:        serveToken,
+			ReportSecret: reportSecret,
+		})
+	})
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// applyBookmarks writes the bookmarks and network settings into the policies and
+// installs them. Failing to insert either is logged and returned as problems rather
+// than err, so the policies are still installed with whatever did apply.
+func applyBookmarks(stationID string) (problems error, err error) {
+	bookmarksErr := utils.InsertBookmarksInPolicies(stationID)
+	if bookmarksErr != nil {
+		log.Err(bookmarksErr).Msg("Failed to install bookmarks")
+	}
+	networkErr := utils.InsertNetworkInPolicies()
+	if networkErr != nil {
+		log.Err(networkErr).Msg("Failed to install browser network settings")
+	}
+	problems = errors.Join(bookmarksErr, networkErr)
+	paths := utils.CurrentPaths()
+	err = utils.CopyDirectoryTo(paths.PoliciesSource, paths.Etc)
+	if err != nil {
+		return problems, fmt.Errorf("failed to copy %s to %s: %w", paths.PoliciesSource, paths.Etc, err)
+	}
+	return problems, nil
+}
+
+func setupBookmarksList(fs *flag.FlagSet) func(args []string) error {
+	stationFlag := fs.String("station", "", "List bookmarks for this station ID instead of the configured one")
+	return noArgs(func() error {
+		stationID := *stationFlag
+		if stationID == "" {
+			cfg, err := utils.LoadConfig()
+			if err != nil {
+				return err
+			}
+			stationID = cfg.StationID
+		}
+		if stationID == "" {
+			return fmt.Errorf("no station ID configured; pass -station")
+		}
+		bookmarks, err := utils.CollectBookmarks(utils.CurrentPaths().Bookmarks, utils.LookupStation(stationID))
+		if err != nil {
+			return fmt.Errorf("failed to collect bookmarks: %w", err)
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "NAME\tURL")
+		for _, bm := range bookmarks {
+			fmt.Fprintf(tw, "%s\t%v\n", bm.Name, bm.URL)
+		}
+		return tw.Flush()
+	})
+}
+
+func setupBookmarksApply(fs *flag.FlagSet) func(args []string) error {
+	return noArgs(func() error {
+		stationID, err := requireStation()
+		if err != nil {
+			return err
+		}
+		_, err = applyBookmarks(stationID)
+		return err
+	})
+}
+
+func setupStationShow(fs *flag.FlagSet) func(args []string) error {
+	return noArgs(func() error {
+		cfg, err := utils.LoadConfig()
+		if err != nil {
+			return err
+		}
+		if cfg.StationID == "" {
+			fmt.Println("station_id: (not set)")
+			return nil
+		}
+		hostname, _ := os.Hostname()
+		station := utils.LookupStation(cfg.StationID)
+		fmt.Printf("station_id: %s\n", cfg.StationID)
+		fmt.Printf("hostname: %s (expected %s)\n", hostname, cfg.StationFormat.Hostname(cfg.StationID))
+		fmt.Printf("group: %s\n", station.Group)
+		fmt.Printf("seat: %s\n", station.Seat)
+		return nil
+	})
+}
+
+func setupStationSet(fs *flag.FlagSet) func(args []string) error {
+	noHostname := fs.Bool("no-hostname", false, "Do not set the hostname from the station ID")
+	return func(args []string) error {
+		if len(args) != 1 {
+			return usageErrorf("station set takes exactly one station ID")
+		}
+		var cfg utils.Config
+		err := utils.UpdateConfig(func(c *utils.Config) error {
+			err := c.Set("station_id", args[0])
+			cfg = *c
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		log.Info().Str("station_id", cfg.StationID).Msg("Station ID set")
+		if *noHostname {
+			return nil
+		}
+		return utils.SetHostname(cfg.StationFormat.Hostname(cfg.StationID))
+	}
+}
+
+func setupStationClear(fs *flag.FlagSet) func(args []string) error {
+	return noArgs(func() error {
+		err := utils.UpdateConfig(func(c *utils.Config) error {
+			c.StationID = ""
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		log.Info().Msg("Station ID cleared")
+		return nil
+	})
+}
+
+func setupStationList(fs *flag.FlagSet) func(args []string) error {
+	return noArgs(func() error {
+		inventory, err := utils.LoadInventory(utils.CurrentPaths().Inventory)
+		if err != nil {
+			return fmt.Errorf("failed to load inventory: %w", err)
+		}
+		return utils.PrintInventory(os.Stdout, inventory)
+	})
+}
+
+func embeddedManifest() (utils.Manifest, error) {
+	assets, err := fs.Sub(embedded, "assets")
+	if err != nil {
+		return utils.Manifest{}, err
+	}
+	return utils.GenerateManifest(assets, version, buildCommit(), utils.AssetMode)
+}
+
+func setupManifestGenerate(fs *flag.FlagSet) func(args []string) error {
+	dir := fs.String("dir", "", "Hash this directory with its on-disk modes instead of the embedded assets")
+	out := fs.String("o", "", "Write the manifest to this file instead of stdout")
+	manifestVersion := fs.String("version", version, "Version to record")
+	manifestCommit := fs.String("commit", buildCommit(), "Commit to record")
+	return noArgs(func() error {
+		var manifest utils.Manifest
+		var err error
+		if *dir == "" {
+			manifest, err = embeddedManifest()
+		} else {
+			manifest, err = utils.GenerateManifest(os.DirFS(*dir), *manifestVersion, *manifestCommit, nil)
+		}
+		if err != nil {
+			return err
+		}
+		manifest.Version = *manifestVersion
+		manifest.Commit = *manifestCommit
+
+		if *out != "" {
+			err = utils.SaveManifest(manifest, *out)
+			if err != nil {
+				return fmt.Errorf("failed to save manifest: %w", err)
+			}
+			log.Info().Str("path", *out).Int("files", len(manifest.Files)).Msg("Manifest written")
+			return nil
+		}
+		logToStderr()
+		return yaml.NewEncoder(os.Stdout).Encode(manifest)
+	})
+}
+
+func setupVerify(fs *flag.FlagSet) func(args []string) error {
+	manifestPath := fs.String("manifest", "", "Manifest to verify against (default <root>/opt/iceslab/manifest.yaml)")
+	asJSON := fs.Bool("json", false, "Print the differences as JSON")
+	return noArgs(func() error {
+		if *asJSON {
+			logToStderr()
+		}
+		paths := utils.CurrentPaths()
+		if *manifestPath == "" {
+			*manifestPath = paths.Manifest
+		}
+		manifest, err := utils.LoadManifest(*manifestPath)
+		if err != nil {
+			return fmt.Errorf("failed to load manifest: %w", err)
+		}
+		diff, err := utils.VerifyManifest(manifest, paths.Assets)
+		if err != nil {
+			return err
+		}
+
+		if *asJSON {
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			encoder.SetEscapeHTML(false)
+			err = encoder.Encode(diff)
+			if err != nil {
+				return err
+			}
+		} else {
+			utils.PrintManifestDiff(os.Stdout, diff)
+		}
+		if !diff.Clean() {
+			return fmt.Errorf("%d missing, %d modified, %d extra files in %s", len(diff.Missing), len(diff.Modified), len(diff.Extra), paths.Assets)
+		}
+		log.Info().Str("version", manifest.Version).Int("files", len(manifest.Files)).Msg("All assets match the manifest")
+		return nil
+	})
+}
+
+// The version output is also the start check for a freshly updated binary.
+func setupVersion(fs *flag.FlagSet) func(args []string) error {
+	return noArgs(func() error {
+		fmt.Printf("iceslab %s %s/%s\n", version, runtime.GOOS, runtime.GOARCH)
+		return nil
+	})
+}
+
+func setupStatus(fs *flag.FlagSet) func(args []string) error {
+	asJSON := fs.Bool("json", false, "Print the report as JSON")
+	return noArgs(func() error {
+		if *asJSON {
+			logToStderr()
+		}
+		report := utils.CollectStatus(version)
+		if *asJSON {
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			return encoder.Encode(report)
+		}
+		return utils.PrintStatus(os.Stdout, report)
+	})
+}
+
+func setupDoctor(fs *flag.FlagSet) func(args []string) error {
+	asJSON := fs.Bool("json", false, "Print the results as JSON")
+	return noArgs(func() error {
+		if *asJSON {
+			logToStderr()
+		}
+		results := utils.RunDoctor(utils.DoctorChecks)
+		var err error
+		if *asJSON {
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			err = encoder.Encode(results)
+		} else {
+			err = utils.PrintCheckResults(os.Stdout, results)
+		}
+		if err != nil {
+			return err
+		}
+
+		failed := 0
+		for _, r := range results {
+			if r.Status == utils.CheckFail {
+				failed++
+			}
+		}
+		if failed > 0 {
+			return fmt.Errorf("%d of %d checks failed", failed, len(results))
+		}
+		return nil
+	})
+}
+
+func setupAssetsDump(fs *flag.FlagSet) func(args []string) error {
+	dest := fs.String("dest", "", "Directory to write the assets to (default: the install root's assets directory)")
+	return noArgs(func() error {
+		if *dest == "" {
+			*dest = utils.CurrentPaths().Assets
+		}
+		log.Info().Str("dest", *dest).Msg("Dumping embedded assets")
+		err := utils.DumpAssets(embedded, "assets", *dest)
+		if err != nil {
+			return fmt.Errorf("failed to dump embedded assets: %w", err)
+		}
+		log.Info().Msg("Embedded assets dumped successfully")
+		return nil
+	})
+}
+
+// Scripts capture the stdout of config and JSON commands, so keep log lines off it.
+func logToStderr() {
+	utils.LogToStderr()
+}
+
+func setupConfigGet(fs *flag.FlagSet) func(args []string) error {
+	return func(args []string) error {
+		logToStderr()
+		if len(args) != 1 {
+			return usageErrorf("config get takes one key (keys: %s)", strings.Join(utils.ConfigKeys(), ", "))
+		}
+		cfg, err := utils.LoadConfig()
+		if err != nil {
+			return err
+		}
+		value, err := cfg.Get(args[0])
+		if err != nil {
+			return usageError{err}
+		}
+		fmt.Println(value)
+		return nil
+	}
+}
+
+func setupConfigSet(fs *flag.FlagSet) func(args []string) error {
+	return func(args []string) error {
+		logToStderr()
+		if len(args) != 2 {
+			return usageErrorf("config set takes a key and a value (keys: %s)", strings.Join(utils.ConfigKeys(), ", "))
+		}
+		return utils.UpdateConfig(func(cfg *utils.Config) error {
+			return cfg.Set(args[0], args[1])
+		})
+	}
+}
@@ -1,10 +1,15 @@
 package main
 
 import (
+	"context"
 	"embed"
 	_ "embed"
+	"errors"
 	"flag"
+	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"iceslab/utils"
@@ -16,164 +21,147 @@ import (
 //go:embed all:assets
 var embedded embed.FS
 
+// runContext is cancelled on SIGINT or SIGTERM, so downloads stop promptly when the
+// user interrupts or systemd stops the unit.
+var runContext = context.Background()
+
+const (
+	exitOK      = 0
+	exitFailure = 1
+	exitUsage   = 2
+)
+
 func main() {
 
 	zerolog.TimeFieldFormat = time.RFC3339
-	log.Logger = log.Output(zerolog.ConsoleWriter{
-		Out:        os.Stdout,
-		TimeFormat: time.RFC3339,
-	})
 	zerolog.SetGlobalLevel(zerolog.InfoLevel)
-
-	var err error
-	var stationID string
+	utils.InitLogging()
 
 	if _, err := os.Stat(".git"); err == nil {
 		log.Fatal().Msg(".git directory found; exiting. Don't run this in your git repo, dumbass.")
 		os.Exit(1)
 	}
 
-	// flagManifest := flag.Bool("manifest", false, "Generate and save manifest.yaml with current binary and assets hashes")
-	// flagUpdate := flag.Bool("update", false, "Fetch latest repo state from GitHub before setup")
-	// flagBuild := flag.Bool("build", false, "Build the iceslab binary from source before setup")
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	runContext = ctx
+	utils.UserAgent = fmt.Sprintf("iceslab/%s (%s; +https://github.com/sstark-mason/iceslab)", version, utils.SelfAssetName())
 
-	update := flag.String("u", "", "Update 's'ource or 'b'ookmarks")
-	install := flag.Bool("i", false, "Install to /opt/iceslab/ and run setup scripts")
-	verbose := flag.Bool("v", false, "Enable verbose logging")
-	dump := flag.Bool("dump", false, "Dump embedded assets")
+	err := run(os.Args[1:])
+	stop()
+	code := exitCode(err)
+	utils.CloseLogging()
+	os.Exit(code)
+}
 
-	flag.Parse()
+func run(args []string) error {
+	global := flag.NewFlagSet("iceslab", flag.ContinueOnError)
+	verbose := global.Bool("v", false, "Enable verbose logging")
+	global.BoolVar(&dryRunFlag, "dry-run", false, dryRunUsage)
+	root := global.String("root", "", "Install root for all paths (default $ICESLAB_ROOT, then 'root' in /etc/iceslab/config.yaml, then /)")
+	logOutputs := global.String("log", "", "Comma-separated log outputs: console, json, file, journald (default $ICESLAB_LOG, then 'log' in the config, then journald under systemd or console)")
+
+	// Deprecated single-letter flags, kept as aliases for the subcommands
+	update := global.String("u", "", "Deprecated: use 'update source' or 'update bookmarks'")
+	install := global.Bool("i", false, "Deprecated: use 'install'")
+	dump := global.Bool("dump", false, "Deprecated: use 'assets dump'")
+	stations := global.Bool("stations", false, "Deprecated: use 'station list'")
+
+	global.Usage = func() { printCommandHelp(os.Stderr, rootCommand, "iceslab", global) }
+	err := global.Parse(args)
+	if errors.Is(err, flag.ErrHelp) {
+		return nil
+	}
+	if err != nil {
+		return usageError{err}
+	}
 
 	if *verbose {
 		zerolog.SetGlobalLevel(zerolog.DebugLevel)
 	}
+	utils.SetRoot(*root)
+	err = utils.ConfigureLogging(*logOutputs)
+	if err != nil {
+		return usageError{err}
+	}
+	utils.SetLogField("station_id", utils.ConfiguredStationID())
 
-	if *dump {
-		log.Info().Msg("Dumping embedded assets")
-		err = utils.DumpAssets(embedded, "assets", "assets")
-		if err != nil {
-			log.Fatal().Err(err).Msg("Failed to dump embedded assets")
+	legacy := legacyCommands(*update, *install, *dump, *stations)
+	if len(legacy) > 0 {
+		for _, commandArgs := range legacy {
+			log.Warn().Msgf("Deprecated flags in use; run 'iceslab %s' instead", joinArgs(commandArgs))
+			err = rootCommand.execute("iceslab", commandArgs)
+			if err != nil {
+				break
+			}
 		}
-		log.Info().Msg("Embedded assets dumped successfully")
+	} else {
+		err = rootCommand.execute("iceslab", global.Args())
 	}
-
-	err = utils.CheckIfCorrectUser()
-	if err != nil {
-		log.Fatal().Err(err).Msg("Exiting on user check")
-		return
+	flushErr := utils.FlushInstallRecord()
+	if flushErr != nil {
+		log.Warn().Err(flushErr).Msg("Failed to update install record")
 	}
 
-	stationID, err = utils.GetStationID()
-	if err != nil {
-		log.Fatal().Err(err).Msg("Failed to get station ID")
+	if utils.DryRun() {
+		planErr := utils.PrintPlan(os.Stdout)
+		if err == nil {
+			err = planErr
+		}
 	}
+	return err
+}
 
-	switch *update {
+// legacyCommands translates the old flags into subcommand invocations. As before,
+// --dump runs first and -u takes precedence over -i.
+func legacyCommands(update string, install, dump, stations bool) [][]string {
+	var commands [][]string
+	if dump {
+		commands = append(commands, []string{"assets", "dump"})
+	}
+	if stations {
+		commands = append(commands, []string{"station", "list"})
+		return commands
+	}
+	switch update {
 	case "s", "source":
-		log.Info().Msg("Updating source code")
-		client := utils.NewClient("")
-		err := client.UpdateSource()
-		if err != nil {
-			log.Fatal().Err(err).Msg("Failed to update source code")
-		}
-		return
+		commands = append(commands, []string{"update", "source"})
 	case "b", "bookmarks":
-		log.Info().Msg("Updating bookmarks")
-		client := utils.NewClient("")
-		err := client.UpdateBookmarkYamls()
-		if err != nil {
-			log.Err(err).Msg("Failed to update bookmarks")
-		}
-		err = utils.InsertBookmarksInPolicies(stationID)
-		if err != nil {
-			log.Err(err).Msg("Failed to install bookmarks")
+		commands = append(commands, []string{"update", "bookmarks"})
+	case "":
+		if install {
+			commands = append(commands, []string{"install"})
 		}
-		err = utils.CopyDirectoryTo("assets/etc/", "/etc/")
-		if err != nil {
-			log.Error().Err(err).Msg("Failed to copy assets/etc/ to /etc/")
-			return
-		}
-		return
+	default:
+		commands = append(commands, []string{"update", update})
 	}
+	return commands
+}
 
-	if *install {
-		installPath := "/opt/iceslab/"
-		log.Info().Str("installPath", installPath).Msg("Installing iceslab to path")
-
-		execPath, err := os.Executable()
-		if err != nil {
-			log.Fatal().Err(err).Msg("Failed to get executable path")
-		}
-
-		if execPath != installPath+"iceslab" {
-			log.Warn().Str("execPath", execPath).Msg("Executable is not running from install path; moving to /opt/iceslab/")
-			err = utils.InstallTo(installPath)
-			if err != nil {
-				log.Fatal().Err(err).Msg("Failed to install to path")
-			}
-			// Re-run the program from the new location with same flags
-			err = utils.RerunBinary(installPath+"iceslab", os.Args[1:]...)
-			os.Exit(0)
-		}
-
-		// if _, err := os.Stat(installPath); err == nil {
-		// 	log.Error().Msg("Existing installation found at installPath; exiting")
-		// 	os.Exit(1)
-		// }
-
-		// err = utils.MoveFile(execPath, installPath+"iceslab")
-		// if err != nil {
-		// 	log.Fatal().Err(err).Msg("Failed to move binary to installPath")
-		// }
-
-		err = utils.DumpAssets(embedded, "assets", installPath+"assets")
-		if err != nil {
-			log.Fatal().Err(err).Msg("Failed to dump assets in installPath")
-		}
-
-		err = utils.InstallPackages(installPath)
-		if err != nil {
-			log.Fatal().Err(err).Msg("Failed to install packages")
-		}
-
-		err = utils.SetupGuestUser(installPath)
-		if err != nil {
-			log.Fatal().Err(err).Msg("Failed to set up guest user")
-		}
+type usageError struct {
+	err error
+}
 
-		err = utils.InsertBookmarksInPolicies(stationID)
-		if err != nil {
-			log.Fatal().Err(err).Msg("Failed to install bookmarks")
-		}
+func (e usageError) Error() string { return e.err.Error() }
+func (e usageError) Unwrap() error { return e.err }
 
-		err = utils.CopyDirectoryTo(installPath+"assets/etc/", "/etc/")
-		if err != nil {
-			log.Error().Err(err).Msg("Failed to copy assets/etc/ to /etc/")
-			return
-		}
-
-		// log.Info().Msg("Installation completed successfully. Rebooting system to apply changes.")
-		// err = utils.RunShellCommand("sudo reboot")
-		// if err != nil {
-		// 	log.Error().Err(err).Msg("Failed to reboot system")
-		// }
+func usageErrorf(format string, args ...any) error {
+	return usageError{fmt.Errorf(format, args...)}
+}
 
-		return
+func exitCode(err error) int {
+	if err == nil {
+		return exitOK
 	}
-
-	// // Run scripts/post-install.sh
-	// postInstallPath := filepath.Join(assetPath, "scripts/post-install.sh")
-	// if err := runScript(postInstallPath); err != nil {
-	// 	log.Fatal().Err(err).Msg("Failed to run post-install script")
-	// 	return
-	// }
-
-	// // Run scripts/guest-template.sh
-	// guestTemplatePath := filepath.Join(assetPath, "scripts/guest-template.sh")
-	// if err := runScript(guestTemplatePath); err != nil {
-	// 	log.Fatal().Err(err).Msg("Failed to run guest-template script")
-	// 	return
-	// }
-
-	// log.Info().Msg("Setup completed successfully")
+	// The re-run has already reported its own failure
+	var rerun *utils.RerunError
+	if errors.As(err, &rerun) {
+		return rerun.Code
+	}
+	var uerr usageError
+	if errors.As(err, &uerr) {
+		log.Error().Err(err).Msg("Invalid usage; see 'iceslab -h'")
+		return exitUsage
+	}
+	log.Error().Err(err).Msg("Command failed")
+	return exitFailure
 }
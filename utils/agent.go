@@ -0,0 +1,160 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// UpdateUnit is the systemd service and timer pair that runs 'iceslab agent run'.
+const UpdateUnit = "iceslab-update"
+
+const (
+	defaultAgentInterval    = time.Hour
+	defaultAgentRandomDelay = 15 * time.Minute
+)
+
+// AgentConfig controls the background update agent. Interval and RandomDelay are
+// written into the timer by 'iceslab agent install'; QuietHours and UpdateBinary are
+// read on every run.
+type AgentConfig struct {
+	Interval    string `yaml:"interval,omitempty" json:"interval,omitempty"`
+	RandomDelay string `yaml:"random_delay,omitempty" json:"random_delay,omitempty"`
+	// QuietHours is a local time range such as "08:00-16:00" during which the agent
+	// does nothing; it may wrap past midnight.
+	QuietHours   string `yaml:"quiet_hours,omitempty" json:"quiet_hours,omitempty"`
+	UpdateBinary bool   `yaml:"update_binary,omitempty" json:"update_binary,omitempty"`
+}
+
+func (a AgentConfig) interval() (time.Duration, error) {
+	return parseAgentDuration(a.Interval, defaultAgentInterval)
+}
+
+func (a AgentConfig) randomDelay() (time.Duration, error) {
+	return parseAgentDuration(a.RandomDelay, defaultAgentRandomDelay)
+}
+
+func parseAgentDuration(value string, fallback time.Duration) (time.Duration, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid duration %q: use e.g. 30m or 2h", value)
+	}
+	return d, nil
+}
+
+// quietHours is a daily window in minutes after midnight; end may be before start.
+type quietHours struct {
+	start, end int
+}
+
+func parseQuietHours(value string) (quietHours, error) {
+	from, to, ok := strings.Cut(value, "-")
+	if !ok {
+		return quietHours{}, fmt.Errorf("invalid quiet hours %q: use HH:MM-HH:MM", value)
+	}
+	start, err := time.Parse("15:04", strings.TrimSpace(from))
+	if err != nil {
+		return quietHours{}, fmt.Errorf("invalid quiet hours %q: use HH:MM-HH:MM", value)
+	}
+	end, err := time.Parse("15:04", strings.TrimSpace(to))
+	if err != nil {
+		return quietHours{}, fmt.Errorf("invalid quiet hours %q: use HH:MM-HH:MM", value)
+	}
+	return quietHours{start: start.Hour()*60 + start.Minute(), end: end.Hour()*60 + end.Minute()}, nil
+}
+
+func (q quietHours) contains(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	if q.start <= q.end {
+		return minute >= q.start && minute < q.end
+	}
+	return minute >= q.start || minute < q.end
+}
+
+// InQuietHours reports whether the agent should stay idle at t.
+func (a AgentConfig) InQuietHours(t time.Time) (bool, error) {
+	if a.QuietHours == "" {
+		return false, nil
+	}
+	q, err := parseQuietHours(a.QuietHours)
+	if err != nil {
+		return false, err
+	}
+	return q.contains(t), nil
+}
+
+// The service runs at low priority so a refresh during a session is not noticed.
+const updateServiceUnit = `[Unit]
+Description=iceslab background update
+Documentation=https://github.com/sstark-mason/iceslab
+Wants=network-online.target
+After=network-online.target
+
+[Service]
+Type=oneshot
+ExecStart=%s -log journald agent run
+Nice=10
+IOSchedulingClass=idle
+`
+
+// RandomizedDelaySec spreads the stations out so they do not all hit the update URL at once.
+const updateTimerUnit = `[Unit]
+Description=Run the iceslab background update periodically
+
+[Timer]
+OnBootSec=%[1]s
+OnUnitActiveSec=%[1]s
+RandomizedDelaySec=%[2]s
+
+[Install]
+WantedBy=timers.target
+`
+
+// InstallAgent writes the update service and timer from the agent config and enables
+// the timer. Run it again after changing agent.interval or agent.random_delay.
+func InstallAgent(cfg AgentConfig) error {
+	interval, err := cfg.interval()
+	if err != nil {
+		return fmt.Errorf("agent.interval: %w", err)
+	}
+	if interval < time.Minute {
+		return fmt.Errorf("agent.interval must be at least 1m, got %s", interval)
+	}
+	delay, err := cfg.randomDelay()
+	if err != nil {
+		return fmt.Errorf("agent.random_delay: %w", err)
+	}
+
+	timerState, _ := ShellOutput("systemctl is-enabled " + UpdateUnit + ".timer")
+	err = writeFile(paths.UpdateService, []byte(fmt.Sprintf(updateServiceUnit, paths.Binary)), 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", paths.UpdateService, err)
+	}
+	err = writeFile(paths.UpdateTimer, []byte(fmt.Sprintf(updateTimerUnit, systemdSeconds(interval), systemdSeconds(delay))), 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", paths.UpdateTimer, err)
+	}
+	err = RunShellCommand("systemctl daemon-reload")
+	if err != nil {
+		return fmt.Errorf("failed to reload systemd: %w", err)
+	}
+	err = RunShellCommand("systemctl enable --now " + UpdateUnit + ".timer")
+	if err != nil {
+		return fmt.Errorf("failed to enable %s.timer: %w", UpdateUnit, err)
+	}
+	if timerState != "enabled" {
+		RecordEnabledUnit(UpdateUnit + ".timer")
+	}
+	log.Info().Dur("interval", interval).Dur("random_delay", delay).Str("timer", paths.UpdateTimer).Msg("Background update agent installed")
+	return nil
+}
+
+// systemdSeconds formats d as a systemd time span, e.g. "3600s".
+func systemdSeconds(d time.Duration) string {
+	return fmt.Sprintf("%ds", int64(d/time.Second))
+}
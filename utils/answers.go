@@ -0,0 +1,82 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"go.yaml.in/yaml/v4"
+)
+
+const (
+	StepPackages  = "packages"
+	StepGuestUser = "guest_user"
+	StepBookmarks = "bookmarks"
+	StepPolicies  = "policies"
+)
+
+// InstallSteps lists every install step in the order install runs them.
+var InstallSteps = []string{StepPackages, StepGuestUser, StepBookmarks, StepPolicies}
+
+// Answers drives a non-interactive install. Every field is required so that a
+// missing answer fails up front instead of falling back to a prompt.
+type Answers struct {
+	StationID string   `yaml:"station_id"`
+	AdminUser string   `yaml:"admin_user"`
+	Steps     []string `yaml:"steps"`
+	Reboot    *bool    `yaml:"reboot"`
+}
+
+func LoadAnswers(path string) (Answers, error) {
+	var answers Answers
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return answers, fmt.Errorf("failed to read answer file: %w", err)
+	}
+	err = yaml.Unmarshal(data, &answers)
+	if err != nil {
+		return answers, fmt.Errorf("failed to parse answer file %s: %w", path, err)
+	}
+	return answers, answers.Validate()
+}
+
+func (a Answers) Validate() error {
+	var missing []string
+	if a.StationID == "" {
+		missing = append(missing, "station_id")
+	}
+	if a.AdminUser == "" {
+		missing = append(missing, "admin_user")
+	}
+	if a.Steps == nil {
+		missing = append(missing, "steps")
+	}
+	if a.Reboot == nil {
+		missing = append(missing, "reboot")
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("answer file is missing: %s", strings.Join(missing, ", "))
+	}
+
+	for _, step := range a.Steps {
+		known := false
+		for _, s := range InstallSteps {
+			if step == s {
+				known = true
+			}
+		}
+		if !known {
+			return fmt.Errorf("unknown install step %q (known steps: %s)", step, strings.Join(InstallSteps, ", "))
+		}
+	}
+	return nil
+}
+
+func (a Answers) Runs(step string) bool {
+	for _, s := range a.Steps {
+		if s == step {
+			return true
+		}
+	}
+	return false
+}
@@ -2,7 +2,6 @@ package utils
 
 import (
 	"archive/zip"
-	"bytes"
 	"fmt"
 	"io"
 	"net/http"
@@ -14,27 +13,25 @@ import (
 	"github.com/rs/zerolog/log"
 )
 
-func CheckForUpdatesByComparingHashes() (bool, bool, error) {
-	localManifest, err := GenerateManifest()
+// Binaries are no longer in the manifest; update self compares them against SHA256SUMS.
+func (c *Client) CheckForUpdatesByComparingHashes(resolution Resolution) (bool, bool, error) {
+	localManifest, err := GenerateManifest(os.DirFS(paths.Assets), "", "", nil)
 	if err != nil {
 		return false, false, err
 	}
 
-	log.Debug().Str("binary_hash", localManifest.BinaryHash).Msg("Generated current binary hash")
-	log.Debug().Str("assets_hash", localManifest.AssetsHash).Msg("Generated current assets hash")
+	log.Debug().Str("assets_hash", localManifest.AssetsHash()).Msg("Generated current assets hash")
 
-	remoteManifest, err := FetchRemoteManifest()
+	remoteManifest, err := c.FetchRemoteManifest(resolution)
 	if err != nil {
 		return false, false, err
 	}
 
-	log.Debug().Str("remote_binary_hash", remoteManifest.BinaryHash).Msg("Fetched remote binary hash")
-	log.Debug().Str("remote_assets_hash", remoteManifest.AssetsHash).Msg("Fetched remote assets hash")
+	log.Debug().Str("remote_assets_hash", remoteManifest.AssetsHash()).Msg("Fetched remote assets hash")
 
-	binaryUpdateAvailable := localManifest.BinaryHash != remoteManifest.BinaryHash
-	assetsUpdateAvailable := localManifest.AssetsHash != remoteManifest.AssetsHash
+	assetsUpdateAvailable := localManifest.AssetsHash() != remoteManifest.AssetsHash()
 
-	return binaryUpdateAvailable, assetsUpdateAvailable, nil
+	return false, assetsUpdateAvailable, nil
 }
 
 func (c *Client) CompareRemoteManifestETag() (bool, error) {
@@ -80,13 +77,14 @@ func (c *Client) Update0() error {
 		return nil
 	}
 
-	zipData, err := c.DownloadSourceZip()
+	zipball, err := c.DownloadSourceZip(Resolution{Channel: branch, Ref: branch})
 	if err != nil {
 		return err
 	}
+	defer zipball.Close()
 	targets := []string{"iceslab", "assets"}
 
-	err = unzipRepoZip0(zipData, targets)
+	err = unzipRepoZip0(zipball, targets)
 	if err != nil {
 		return err
 	}
@@ -105,10 +103,11 @@ func (c *Client) Update() error {
 		return nil
 	}
 
-	zipData, err := c.DownloadSourceZip()
+	zipball, err := c.DownloadSourceZip(Resolution{Channel: branch, Ref: branch})
 	if err != nil {
 		return err
 	}
+	defer zipball.Close()
 	targets := []string{"iceslab", "assets"}
 
 	// Create a temporary directory for extraction
@@ -118,7 +117,7 @@ func (c *Client) Update() error {
 	}
 	// Do not defer remove; let the shell command handle cleanup
 
-	err = unzipRepoZip(zipData, targets, tempDir)
+	err = unzipRepoZip(zipball, targets, tempDir)
 	if err != nil {
 		os.RemoveAll(tempDir) // Clean up on error
 		return err
@@ -136,8 +135,8 @@ func (c *Client) Update() error {
 	return nil
 }
 
-func unzipRepoZip0(zipData []byte, targets []string) error {
-	zr, err := zip.NewReader(bytes.NewReader(zipData), int64(len(zipData)))
+func unzipRepoZip0(zipball *downloadedFile, targets []string) error {
+	zr, err := zip.NewReader(zipball, zipball.Size)
 	if err != nil {
 		return fmt.Errorf("failed to create zip reader: %w", err)
 	}
@@ -193,8 +192,8 @@ func unzipRepoZip0(zipData []byte, targets []string) error {
 	return nil
 }
 
-func unzipRepoZip(zipData []byte, targets []string, destDir string) error {
-	zr, err := zip.NewReader(bytes.NewReader(zipData), int64(len(zipData)))
+func unzipRepoZip(zipball *downloadedFile, targets []string, destDir string) error {
+	zr, err := zip.NewReader(zipball, zipball.Size)
 	if err != nil {
 		return fmt.Errorf("failed to create zip reader: %w", err)
 	}
@@ -308,9 +307,8 @@ func (c *Client) FetchManifestETag() (string, error) {
 		fmt.Sprintf("https://api.github.com/repos/%s/%s/contents/manifest.yaml", owner, repo),
 		nil,
 	)
-	req.Header.Set("User-Agent", "iceslab-script")
 
-	resp, err := c.http.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return "", err
 	}
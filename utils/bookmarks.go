@@ -6,43 +6,80 @@ import (
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 
 	"github.com/rs/zerolog/log"
 	"go.yaml.in/yaml/v4"
 )
 
 type Bookmark struct {
-	name string `yaml:"name"`
-	url  any    `yaml:"url"`
+	Name string `yaml:"name" json:"name"`
+	URL  any    `yaml:"url" json:"url"`
+	// Groups limits the bookmark to stations in these inventory groups; empty means all stations.
+	Groups []string `yaml:"groups" json:"-"`
 }
 
-func (b *Bookmark) GetURL(stationNum string) (Bookmark, error) {
+func (b *Bookmark) TargetsGroup(group string) bool {
+	if len(b.Groups) == 0 {
+		return true
+	}
+	for _, g := range b.Groups {
+		if g == group {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *Bookmark) GetURL(stationID string) (Bookmark, error) {
 	// TODO: Maybe rewrite this function; it feels cursed for some reason.
-	switch url := b.url.(type) {
+	stationNum, isNumbered := StationNumber(stationID)
+	switch url := b.URL.(type) {
 	case string:
-		return Bookmark{name: b.name, url: url}, nil
+		return Bookmark{Name: b.Name, URL: url}, nil
 	case map[any]any:
-		// Try lookup with stationNum as string
-		if urlVal, ok := url[stationNum]; ok {
-			if urlStr, ok := urlVal.(string); ok {
-				return Bookmark{name: b.name, url: urlStr}, nil
+		// Try lookup with the station ID as string, e.g. "B12"
+		for key, urlVal := range url {
+			if keyStr, ok := key.(string); ok && strings.EqualFold(keyStr, stationID) {
+				if urlStr, ok := urlVal.(string); ok {
+					return Bookmark{Name: b.Name, URL: urlStr}, nil
+				}
+			}
+		}
+		// If not found, try the numeric part of the ID (for YAML keys like 01 parsed as 1)
+		if isNumbered {
+			if urlVal, ok := url[stationNum]; ok {
+				if urlStr, ok := urlVal.(string); ok {
+					return Bookmark{Name: b.Name, URL: urlStr}, nil
+				}
 			}
 		}
-		// If not found, try parsing stationNum to int (for YAML keys like 01 parsed as 1)
-		if stationInt, err := strconv.Atoi(stationNum); err == nil {
-			if urlVal, ok := url[stationInt]; ok {
+	case map[string]any:
+		// yaml decodes a map whose keys are all strings ("B12", "07") as map[string]any
+		for key, urlVal := range url {
+			if strings.EqualFold(key, stationID) {
 				if urlStr, ok := urlVal.(string); ok {
-					return Bookmark{name: b.name, url: urlStr}, nil
+					return Bookmark{Name: b.Name, URL: urlStr}, nil
+				}
+			}
+		}
+		// If not found, compare the numeric part of the ID, so "7" and "07" both match B07
+		if isNumbered {
+			for key, urlVal := range url {
+				if keyNum, err := strconv.Atoi(key); err == nil && keyNum == stationNum {
+					if urlStr, ok := urlVal.(string); ok {
+						return Bookmark{Name: b.Name, URL: urlStr}, nil
+					}
 				}
 			}
 		}
 	case []any:
-		// Try to index by stationNum
-		if stationInt, err := strconv.Atoi(stationNum); err == nil && stationInt > 0 {
-			index := stationInt - 1
+		// Try to index by the numeric part of the ID
+		if isNumbered && stationNum > 0 {
+			index := stationNum - 1
 			if index >= 0 && index < len(url) {
 				if urlStr, ok := url[index].(string); ok {
-					return Bookmark{name: b.name, url: urlStr}, nil
+					return Bookmark{Name: b.Name, URL: urlStr}, nil
 				}
 			}
 		}
@@ -50,14 +87,14 @@ func (b *Bookmark) GetURL(stationNum string) (Bookmark, error) {
 		// Fall back to the first URL in the array if stationNum isn't found or if it's an array
 		if len(url) > 0 {
 			if urlStr, ok := url[0].(string); ok {
-				return Bookmark{name: b.name, url: urlStr}, nil
+				return Bookmark{Name: b.Name, URL: urlStr}, nil
 			}
 		}
 	}
-	return Bookmark{}, fmt.Errorf("invalid bookmark URL format for %s", b.name)
+	return Bookmark{}, fmt.Errorf("invalid bookmark URL format for %s", b.Name)
 }
 
-func CollectBookmarks(dir string, stationNum string) ([]Bookmark, error) {
+func CollectBookmarks(dir string, station Station) ([]Bookmark, error) {
 	var bookmarks []Bookmark
 	entries, err := os.ReadDir(dir)
 	if err != nil {
@@ -66,7 +103,7 @@ func CollectBookmarks(dir string, stationNum string) ([]Bookmark, error) {
 
 	for _, entry := range entries {
 		if entry.IsDir() {
-			subBookmarks, err := CollectBookmarks(filepath.Join(dir, entry.Name()), stationNum)
+			subBookmarks, err := CollectBookmarks(filepath.Join(dir, entry.Name()), station)
 			if err != nil {
 				log.Warn().Err(err).Str("directory", entry.Name()).Msg("Failed to collect bookmarks from subdirectory")
 				continue
@@ -85,7 +122,11 @@ func CollectBookmarks(dir string, stationNum string) ([]Bookmark, error) {
 				log.Warn().Err(err).Str("file", entry.Name()).Msg("Failed to parse bookmark file")
 				continue
 			}
-			finalBM, err := bm.GetURL(stationNum)
+			if !bm.TargetsGroup(station.Group) {
+				log.Debug().Str("file", entry.Name()).Str("group", station.Group).Msg("Bookmark not targeted at station group; skipping")
+				continue
+			}
+			finalBM, err := bm.GetURL(station.ID)
 			if err != nil {
 				log.Warn().Err(err).Str("file", entry.Name()).Msg("Failed to get bookmark URL for station")
 				continue
@@ -95,7 +136,7 @@ func CollectBookmarks(dir string, stationNum string) ([]Bookmark, error) {
 	}
 
 	for _, bm := range bookmarks {
-		log.Debug().Str("name", bm.name).Str("url", fmt.Sprintf("%v", bm.url)).Msg("Collected bookmark")
+		log.Debug().Str("name", bm.Name).Str("url", fmt.Sprintf("%v", bm.URL)).Msg("Collected bookmark")
 	}
 
 	return bookmarks, nil
@@ -129,5 +170,5 @@ func InsertBookmarks(browser string, path string, bookmarks []Bookmark) error {
 	}
 
 	// Write back to file
-	return os.WriteFile(path, updatedData, 0644)
+	return writeFile(path, updatedData, 0644)
 }
@@ -0,0 +1,50 @@
+package utils
+
+import (
+	"testing"
+
+	"go.yaml.in/yaml/v4"
+)
+
+func TestGetURL(t *testing.T) {
+	tests := []struct {
+		name      string
+		yaml      string
+		stationID string
+		want      string
+	}{
+		{"string keys, alphanumeric ID", "url:\n  B12: https://b12.example\n  \"07\": https://07.example\n", "B12", "https://b12.example"},
+		{"string keys, case-insensitive", "url:\n  B12: https://b12.example\n", "b12", "https://b12.example"},
+		{"string keys, zero-padded", "url:\n  \"07\": https://07.example\n  B12: https://b12.example\n", "07", "https://07.example"},
+		{"string keys, numeric part", "url:\n  \"7\": https://7.example\n  B12: https://b12.example\n", "B07", "https://7.example"},
+		{"integer keys", "url:\n  1: https://1.example\n  2: https://2.example\n", "02", "https://2.example"},
+		{"list by number", "url:\n  - https://1.example\n  - https://2.example\n", "02", "https://2.example"},
+		{"list falls back to first", "url:\n  - https://1.example\n", "B09", "https://1.example"},
+		{"plain string", "url: https://all.example\n", "B12", "https://all.example"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var bookmark Bookmark
+			err := yaml.Unmarshal([]byte("name: test\n"+test.yaml), &bookmark)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := bookmark.GetURL(test.stationID)
+			if err != nil {
+				t.Fatalf("GetURL(%q): %v", test.stationID, err)
+			}
+			if got.URL != test.want {
+				t.Errorf("GetURL(%q) = %v, want %s", test.stationID, got.URL, test.want)
+			}
+		})
+	}
+
+	var bookmark Bookmark
+	err := yaml.Unmarshal([]byte("name: test\nurl:\n  B12: https://b12.example\n"), &bookmark)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := bookmark.GetURL("C03"); err == nil {
+		t.Errorf("GetURL(C03) = %v, want an error", got.URL)
+	}
+}
@@ -0,0 +1,179 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"go.yaml.in/yaml/v4"
+)
+
+const (
+	ProxyModeNone   = "none"
+	ProxyModeSystem = "system"
+	ProxyModeManual = "manual"
+	ProxyModePAC    = "pac"
+)
+
+type ProxySettings struct {
+	Mode    string   `yaml:"mode" json:"mode"`
+	HTTP    string   `yaml:"http" json:"http"`
+	HTTPS   string   `yaml:"https" json:"https"`
+	NoProxy []string `yaml:"no_proxy" json:"no_proxy"`
+	PACURL  string   `yaml:"pac_url" json:"pac_url"`
+}
+
+// BrowserNetwork holds the per-lab network settings written into the browser policies.
+// An empty proxy mode or a nil DNSOverHTTPS leaves the corresponding policy unset.
+type BrowserNetwork struct {
+	Proxy        ProxySettings `yaml:"proxy" json:"proxy"`
+	DNSOverHTTPS *bool         `yaml:"dns_over_https" json:"dns_over_https"`
+}
+
+func LoadBrowserNetwork(path string) (BrowserNetwork, error) {
+	var settings BrowserNetwork
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return settings, err
+	}
+	err = yaml.Unmarshal(data, &settings)
+	if err != nil {
+		return settings, err
+	}
+	return settings, settings.Validate()
+}
+
+func (n BrowserNetwork) Validate() error {
+	switch n.Proxy.Mode {
+	case "", ProxyModeNone, ProxyModeSystem:
+		return nil
+	case ProxyModeManual:
+		if n.Proxy.HTTP == "" && n.Proxy.HTTPS == "" {
+			return fmt.Errorf("manual proxy mode requires an http or https proxy")
+		}
+		return nil
+	case ProxyModePAC:
+		if n.Proxy.PACURL == "" {
+			return fmt.Errorf("pac proxy mode requires pac_url")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown proxy mode %q", n.Proxy.Mode)
+	}
+}
+
+func (n BrowserNetwork) firefoxProxy() map[string]any {
+	proxy := map[string]any{"Locked": true}
+	switch n.Proxy.Mode {
+	case ProxyModeNone:
+		proxy["Mode"] = "none"
+	case ProxyModeSystem:
+		proxy["Mode"] = "system"
+	case ProxyModeManual:
+		proxy["Mode"] = "manual"
+		if n.Proxy.HTTP != "" {
+			proxy["HTTPProxy"] = n.Proxy.HTTP
+		}
+		if n.Proxy.HTTPS != "" {
+			proxy["SSLProxy"] = n.Proxy.HTTPS
+		} else {
+			proxy["UseHTTPProxyForAllProtocols"] = true
+		}
+		if len(n.Proxy.NoProxy) > 0 {
+			proxy["Passthrough"] = strings.Join(n.Proxy.NoProxy, ", ")
+		}
+	case ProxyModePAC:
+		proxy["Mode"] = "autoConfig"
+		proxy["AutoConfigURL"] = n.Proxy.PACURL
+	}
+	return proxy
+}
+
+func (n BrowserNetwork) chromiumProxy() map[string]any {
+	proxy := map[string]any{}
+	switch n.Proxy.Mode {
+	case ProxyModeNone:
+		proxy["ProxyMode"] = "direct"
+	case ProxyModeSystem:
+		proxy["ProxyMode"] = "system"
+	case ProxyModeManual:
+		proxy["ProxyMode"] = "fixed_servers"
+		var servers []string
+		switch {
+		case n.Proxy.HTTPS == "":
+			// A bare host:port covers every scheme, like Firefox's UseHTTPProxyForAllProtocols
+			servers = append(servers, n.Proxy.HTTP)
+		case n.Proxy.HTTP == "":
+			servers = append(servers, "https="+n.Proxy.HTTPS)
+		default:
+			servers = append(servers, "http="+n.Proxy.HTTP, "https="+n.Proxy.HTTPS)
+		}
+		proxy["ProxyServer"] = strings.Join(servers, ";")
+		if len(n.Proxy.NoProxy) > 0 {
+			proxy["ProxyBypassList"] = strings.Join(n.Proxy.NoProxy, ";")
+		}
+	case ProxyModePAC:
+		proxy["ProxyMode"] = "pac_script"
+		proxy["ProxyPacUrl"] = n.Proxy.PACURL
+	}
+	return proxy
+}
+
+func InsertNetworkSettings(browser string, path string, settings BrowserNetwork) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var policies map[string]any
+	if err := json.Unmarshal(data, &policies); err != nil {
+		return err
+	}
+
+	switch browser {
+	case "firefox":
+		ffPolicies, ok := policies["policies"].(map[string]any)
+		if !ok {
+			return fmt.Errorf("firefox policies file %s has no policies object", path)
+		}
+		if settings.Proxy.Mode == "" {
+			delete(ffPolicies, "Proxy")
+		} else {
+			ffPolicies["Proxy"] = settings.firefoxProxy()
+		}
+		if settings.DNSOverHTTPS == nil {
+			delete(ffPolicies, "DNSOverHTTPS")
+		} else {
+			ffPolicies["DNSOverHTTPS"] = map[string]any{
+				"Enabled": *settings.DNSOverHTTPS,
+				"Locked":  true,
+			}
+		}
+	case "chromium":
+		if settings.Proxy.Mode == "" {
+			delete(policies, "ProxySettings")
+		} else {
+			policies["ProxySettings"] = settings.chromiumProxy()
+		}
+		switch {
+		case settings.DNSOverHTTPS == nil:
+			delete(policies, "DnsOverHttpsMode")
+		case *settings.DNSOverHTTPS:
+			policies["DnsOverHttpsMode"] = "automatic"
+		default:
+			policies["DnsOverHttpsMode"] = "off"
+		}
+	default:
+		return fmt.Errorf("unknown browser %q", browser)
+	}
+
+	updatedData, err := json.MarshalIndent(policies, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	log.Debug().Str("browser", browser).Str("proxy_mode", settings.Proxy.Mode).Msg("Network settings inserted into policies")
+	return writeFile(path, updatedData, 0644)
+}
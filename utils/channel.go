@@ -0,0 +1,282 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	ChannelStable = "stable"
+	ChannelBeta   = "beta"
+)
+
+// Channels picks which published version a station installs. Each is "stable",
+// "beta", a release tag such as v1.4.0, or a commit SHA. Empty means stable.
+type Channels struct {
+	Binary    string `yaml:"binary,omitempty" json:"binary,omitempty"`
+	Bookmarks string `yaml:"bookmarks,omitempty" json:"bookmarks,omitempty"`
+}
+
+var commitPattern = regexp.MustCompile(`^[0-9a-f]{7,40}$`)
+
+// ValidateChannel accepts stable, beta, a commit SHA or anything that can be a tag name.
+func ValidateChannel(channel string) error {
+	switch {
+	case channel == "", channel == ChannelStable, channel == ChannelBeta, commitPattern.MatchString(channel):
+		return nil
+	case strings.ContainsAny(channel, " \t\n~^:?*[\\") || strings.Contains(channel, ".."):
+		return fmt.Errorf("invalid channel %q: use stable, beta, a release tag or a commit SHA", channel)
+	default:
+		return nil
+	}
+}
+
+// Resolution is what a channel points at right now.
+type Resolution struct {
+	Channel string `json:"channel"`
+	// Ref is the release tag or commit SHA that would be installed.
+	Ref      string `json:"ref"`
+	IsCommit bool   `json:"is_commit"`
+	// Published is when the release was published, for stable and beta.
+	Published *time.Time `json:"published,omitempty"`
+}
+
+// The paths below are relative to the update URL and follow GitHub's layout, so the
+// same code reads github.com and a mirror (see MirrorSync).
+
+func (r Resolution) releaseAssetPath(asset string) string {
+	return releaseAssetPath(r.Ref, asset)
+}
+
+func (r Resolution) zipballPath() string {
+	return "zipball/" + r.Ref
+}
+
+func (r Resolution) rawPath(file string) string {
+	return "raw/" + r.Ref + "/" + file
+}
+
+func releaseAssetPath(tag, asset string) string {
+	return "releases/download/" + tag + "/" + asset
+}
+
+// ResolveBinaryChannel finds the release (or commit) the binary and source channel
+// points at. Stable is the latest full release, beta the newest release including
+// pre-releases; only v* tags count, so the bookmarks and inventory releases never do.
+func (c *Client) ResolveBinaryChannel(channel string) (Resolution, error) {
+	resolution := Resolution{Channel: orStable(channel)}
+	switch resolution.Channel {
+	case ChannelStable, ChannelBeta:
+		releases, err := c.listReleases()
+		if err != nil {
+			return resolution, fmt.Errorf("failed to list releases: %w", err)
+		}
+		for _, release := range releases {
+			if release.Draft || !strings.HasPrefix(release.TagName, "v") {
+				continue
+			}
+			if release.Prerelease && resolution.Channel == ChannelStable {
+				continue
+			}
+			resolution.Ref = release.TagName
+			if !release.PublishedAt.IsZero() {
+				resolution.Published = &release.PublishedAt
+			}
+			return resolution, nil
+		}
+		return resolution, fmt.Errorf("no %s release found", resolution.Channel)
+	default:
+		return pinned(resolution), nil
+	}
+}
+
+// ResolveBookmarksChannel maps the bookmarks channel to the release that carries
+// bookmarks.zip. Stable and beta are rolling tags, so no API call is needed at login.
+func ResolveBookmarksChannel(channel string) Resolution {
+	resolution := Resolution{Channel: orStable(channel)}
+	switch resolution.Channel {
+	case ChannelStable:
+		resolution.Ref = "bookmarks-latest"
+	case ChannelBeta:
+		resolution.Ref = "bookmarks-beta"
+	default:
+		return pinned(resolution)
+	}
+	return resolution
+}
+
+// inventoryPath follows the bookmarks channel, since bookmarks target inventory groups.
+func (r Resolution) inventoryPath() string {
+	switch {
+	case r.Channel == ChannelStable:
+		return releaseAssetPath("inventory-latest", "inventory.yaml")
+	case r.Channel == ChannelBeta:
+		return releaseAssetPath("inventory-beta", "inventory.yaml")
+	case r.IsCommit:
+		return r.rawPath("assets/inventory.yaml")
+	default:
+		return r.releaseAssetPath("inventory.yaml")
+	}
+}
+
+// bookmarksPath is a zipball for commits, which have no bookmarks release.
+func (r Resolution) bookmarksPath() string {
+	if r.IsCommit {
+		return r.zipballPath()
+	}
+	return r.releaseAssetPath("bookmarks.zip")
+}
+
+func pinned(resolution Resolution) Resolution {
+	resolution.Ref = resolution.Channel
+	resolution.IsCommit = commitPattern.MatchString(resolution.Channel)
+	return resolution
+}
+
+// isPinned reports whether the channel names a fixed tag or commit, which the staged
+// rollout never holds back.
+func (r Resolution) isPinned() bool {
+	return r.Channel != ChannelStable && r.Channel != ChannelBeta
+}
+
+func orStable(channel string) string {
+	if channel == "" {
+		return ChannelStable
+	}
+	return channel
+}
+
+type githubRelease struct {
+	TagName     string    `json:"tag_name"`
+	Draft       bool      `json:"draft"`
+	Prerelease  bool      `json:"prerelease"`
+	PublishedAt time.Time `json:"published_at"`
+}
+
+// releasesListPath stands in for the GitHub releases API on a mirror.
+const releasesListPath = "releases.json"
+
+// releasesCache keeps the last release list from the API. Revalidating it with its
+// ETag does not count against the rate limit, and it stands in for the API when the
+// limit is reached.
+type releasesCache struct {
+	URL      string          `json:"url"`
+	ETag     string          `json:"etag"`
+	Releases []githubRelease `json:"releases"`
+}
+
+// listReleases returns the newest releases first, from the GitHub API when the update
+// URL is a repository on github.com or, for a mirror, from its releases.json.
+func (c *Client) listReleases() ([]githubRelease, error) {
+	repo, ok := c.githubRepo()
+	if !ok {
+		data, _, err := c.fetchIfChanged(c.url(releasesListPath), "")
+		if err != nil {
+			return nil, err
+		}
+		return decodeReleases(data)
+	}
+
+	url := fmt.Sprintf("%s/repos/%s/releases?per_page=30", c.apiURL, repo)
+	cache, cached := loadReleasesCache(url)
+	data, etag, err := c.fetchIfChanged(url, cache.ETag)
+	switch {
+	case errors.Is(err, errRateLimited) && cached:
+		log.Warn().Err(err).Msg("Using the cached release list")
+		return cache.Releases, nil
+	case err != nil:
+		return nil, err
+	case data == nil:
+		log.Debug().Str("etag", etag).Msg("Release list unchanged")
+		return cache.Releases, nil
+	}
+
+	releases, err := decodeReleases(data)
+	if err != nil {
+		return nil, err
+	}
+	data, err = json.Marshal(releasesCache{URL: url, ETag: etag, Releases: releases})
+	if err == nil {
+		err = writeFile(paths.ReleasesCache, data, 0644)
+	}
+	if err != nil {
+		log.Debug().Err(err).Msg("Failed to cache the release list")
+	}
+	return releases, nil
+}
+
+func loadReleasesCache(url string) (releasesCache, bool) {
+	var cache releasesCache
+	data, err := os.ReadFile(paths.ReleasesCache)
+	if err != nil || json.Unmarshal(data, &cache) != nil || cache.URL != url {
+		return releasesCache{}, false
+	}
+	return cache, true
+}
+
+func decodeReleases(data []byte) ([]githubRelease, error) {
+	var releases []githubRelease
+	err := json.Unmarshal(data, &releases)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode release list: %w", err)
+	}
+	return releases, nil
+}
+
+// UpdateCheck reports, per component, what is installed and what its channel would
+// install now.
+type UpdateCheck struct {
+	Component string     `json:"component"`
+	Installed string     `json:"installed"`
+	Available Resolution `json:"available"`
+	// Pending is whether an update would install something new.
+	Pending bool   `json:"pending"`
+	Error   string `json:"error,omitempty"`
+}
+
+func (c *Client) CheckUpdates(binaryVersion string, channels Channels) []UpdateCheck {
+	binary := UpdateCheck{Component: "binary", Installed: binaryVersion}
+	var err error
+	binary.Available, err = c.ResolveBinaryChannel(channels.Binary)
+	if err != nil {
+		binary.Error = err.Error()
+	}
+	binary.Pending = binary.Error == "" && binary.Installed != binary.Available.Ref
+	source := UpdateCheck{Component: "source", Installed: readVersionFile(paths.SourceVersion), Available: binary.Available, Error: binary.Error}
+	source.Pending = source.Error == "" && source.Installed != source.Available.Ref
+	bookmarks := UpdateCheck{
+		Component: "bookmarks",
+		Installed: readVersionFile(paths.BookmarksVersion),
+		Available: ResolveBookmarksChannel(channels.Bookmarks),
+	}
+	bookmarks.Pending = bookmarks.Installed != bookmarks.Available.Ref
+	if !bookmarks.Pending && !bookmarks.Available.isPinned() {
+		// Stable and beta are rolling tags, so only the bundle's ETag tells a new one
+		localETag := readVersionFile(paths.BookmarksETag)
+		response, err := c.headBookmarks(bookmarks.Available, localETag)
+		if err != nil {
+			bookmarks.Error = err.Error()
+		} else {
+			bookmarks.Pending = response.StatusCode == http.StatusOK && response.Header.Get("ETag") != localETag
+		}
+	}
+	return []UpdateCheck{binary, source, bookmarks}
+}
+
+func readVersionFile(path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+var errBinaryPinnedToCommit = errors.New("binary channel is pinned to a commit, which has no release binary; pin a release tag or use 'update source'")
@@ -0,0 +1,345 @@
+package utils
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"go.yaml.in/yaml/v4"
+)
+
+// Config is the station configuration shared by the binary and the shell scripts.
+// Scripts read it through `iceslab config get <key>`.
+type Config struct {
+	// Root relocates the whole iceslab tree; see SetRoot.
+	Root string `yaml:"root,omitempty" json:"root,omitempty"`
+
+	StationID           string `yaml:"station_id" json:"station_id"`
+	PostInstallComplete bool   `yaml:"post_install_complete" json:"post_install_complete"`
+
+	StationFormat StationIDFormat `yaml:"station_format,omitempty" json:"station_format"`
+
+	Channel Channels `yaml:"channel,omitempty" json:"channel"`
+	// UpdateURL replaces GitHub for every download: an http(s) mirror, a file://
+	// URL or a directory such as a USB mount, laid out by 'iceslab mirror sync'.
+	UpdateURL string `yaml:"update_url,omitempty" json:"update_url,omitempty"`
+	// AllowUnverified installs release assets that should have a published checksum
+	// but have none, e.g. from a mirror of releases made before checksums were published.
+	AllowUnverified bool `yaml:"allow_unverified,omitempty" json:"allow_unverified,omitempty"`
+
+	Agent   AgentConfig   `yaml:"agent,omitempty" json:"agent"`
+	Rollout RolloutConfig `yaml:"rollout,omitempty" json:"rollout"`
+
+	// Log lists the log outputs (see LogOutputs) used when neither -log nor
+	// $ICESLAB_LOG is set.
+	Log []string `yaml:"log,omitempty" json:"log,omitempty"`
+}
+
+// ConfigKeys returns the keys accepted by Get and Set.
+func ConfigKeys() []string {
+	return []string{
+		"agent.interval", "agent.quiet_hours", "agent.random_delay", "agent.update_binary", "allow_unverified",
+		"channel.binary", "channel.bookmarks", "post_install_complete",
+		"rollout.canary_group", "rollout.canary_percent", "rollout.report_url", "rollout.soak",
+		"station_id", "update_url",
+	}
+}
+
+func (c *Config) Get(key string) (string, error) {
+	switch key {
+	case "station_id":
+		return c.StationID, nil
+	case "post_install_complete":
+		return strconv.FormatBool(c.PostInstallComplete), nil
+	case "channel.binary":
+		return orStable(c.Channel.Binary), nil
+	case "channel.bookmarks":
+		return orStable(c.Channel.Bookmarks), nil
+	case "update_url":
+		if c.UpdateURL == "" {
+			return defaultUpdateURL, nil
+		}
+		return NormalizeUpdateURL(c.UpdateURL), nil
+	case "agent.interval":
+		d, err := c.Agent.interval()
+		return d.String(), err
+	case "agent.random_delay":
+		d, err := c.Agent.randomDelay()
+		return d.String(), err
+	case "agent.quiet_hours":
+		return c.Agent.QuietHours, nil
+	case "agent.update_binary":
+		return strconv.FormatBool(c.Agent.UpdateBinary), nil
+	case "allow_unverified":
+		return strconv.FormatBool(c.AllowUnverified), nil
+	case "rollout.canary_group":
+		return c.Rollout.CanaryGroup, nil
+	case "rollout.canary_percent":
+		return strconv.Itoa(c.Rollout.CanaryPercent), nil
+	case "rollout.soak":
+		d, err := c.Rollout.soak()
+		return d.String(), err
+	case "rollout.report_url":
+		return c.Rollout.ReportURL, nil
+	default:
+		return "", fmt.Errorf("unknown config key %q (known keys: %s)", key, strings.Join(ConfigKeys(), ", "))
+	}
+}
+
+func (c *Config) Set(key, value string) error {
+	switch key {
+	case "station_id":
+		if strings.TrimSpace(value) == "" {
+			c.StationID = ""
+			return nil
+		}
+		ID, err := c.StationFormat.Normalize(value)
+		if err != nil {
+			return err
+		}
+		c.StationID = ID
+	case "post_install_complete":
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid value %q for %s: %w", value, key, err)
+		}
+		c.PostInstallComplete = b
+	case "update_url":
+		value = NormalizeUpdateURL(value)
+		switch {
+		case value == "", value == defaultUpdateURL:
+			c.UpdateURL = ""
+		case strings.HasPrefix(value, "http://"), strings.HasPrefix(value, "https://"), strings.HasPrefix(value, "file://"):
+			c.UpdateURL = value
+		default:
+			return fmt.Errorf("invalid update_url %q: use an http(s):// or file:// URL or an absolute directory", value)
+		}
+	case "agent.interval", "agent.random_delay":
+		value = strings.TrimSpace(value)
+		_, err := parseAgentDuration(value, 0)
+		if err != nil {
+			return err
+		}
+		if key == "agent.interval" {
+			c.Agent.Interval = value
+		} else {
+			c.Agent.RandomDelay = value
+		}
+	case "agent.quiet_hours":
+		value = strings.TrimSpace(value)
+		if value != "" {
+			_, err := parseQuietHours(value)
+			if err != nil {
+				return err
+			}
+		}
+		c.Agent.QuietHours = value
+	case "agent.update_binary":
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid value %q for %s: %w", value, key, err)
+		}
+		c.Agent.UpdateBinary = b
+	case "allow_unverified":
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid value %q for %s: %w", value, key, err)
+		}
+		c.AllowUnverified = b
+	case "rollout.canary_group":
+		c.Rollout.CanaryGroup = strings.TrimSpace(value)
+	case "rollout.canary_percent":
+		percent, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || percent < 0 || percent > 100 {
+			return fmt.Errorf("invalid value %q for %s: use a whole number from 0 to 100", value, key)
+		}
+		c.Rollout.CanaryPercent = percent
+	case "rollout.soak":
+		value = strings.TrimSpace(value)
+		_, err := parseAgentDuration(value, 0)
+		if err != nil {
+			return err
+		}
+		c.Rollout.Soak = value
+	case "rollout.report_url":
+		value = NormalizeUpdateURL(value)
+		if value != "" && !strings.HasPrefix(value, "http://") && !strings.HasPrefix(value, "https://") && !strings.HasPrefix(value, "file://") {
+			return fmt.Errorf("invalid rollout.report_url %q: use an http(s):// or file:// URL or an absolute directory", value)
+		}
+		c.Rollout.ReportURL = value
+	case "channel.binary", "channel.bookmarks":
+		value = strings.TrimSpace(value)
+		err := ValidateChannel(value)
+		if err != nil {
+			return err
+		}
+		if value == ChannelStable {
+			value = ""
+		}
+		if key == "channel.binary" {
+			c.Channel.Binary = value
+		} else {
+			c.Channel.Bookmarks = value
+		}
+	default:
+		return fmt.Errorf("unknown config key %q (known keys: %s)", key, strings.Join(ConfigKeys(), ", "))
+	}
+	return nil
+}
+
+// LoadConfig reads the station config, migrating the legacy INI file and the
+// working-directory .station_id file the first time it runs.
+func LoadConfig() (Config, error) {
+	var cfg Config
+	data, err := os.ReadFile(paths.Config)
+	switch {
+	case err == nil:
+		err = yaml.Unmarshal(data, &cfg)
+		if err != nil {
+			return cfg, fmt.Errorf("failed to parse %s: %w", paths.Config, err)
+		}
+		return cfg, nil
+	case os.IsNotExist(err):
+		return migrateLegacyConfig()
+	default:
+		return cfg, fmt.Errorf("failed to read %s: %w", paths.Config, err)
+	}
+}
+
+func SaveConfig(cfg Config) error {
+	data, err := yaml.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+	if planEffect(EffectWrite, paths.Config, fmt.Sprintf("%d bytes, mode 0644", len(data))) {
+		return nil
+	}
+	err = recordWrite(paths.Config, data)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(paths.ConfigDir, 0755)
+	if err != nil {
+		return fmt.Errorf("failed to create config directory: %w", err)
+	}
+
+	// Write beside the target and rename so scripts never read a half-written file
+	tmp, err := os.CreateTemp(paths.ConfigDir, ".config-*.yaml")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary config file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write temporary config file: %w", err)
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	err = os.Rename(tmp.Name(), paths.Config)
+	if err != nil {
+		return fmt.Errorf("failed to replace %s: %w", paths.Config, err)
+	}
+	SetLogField("station_id", cfg.StationID)
+	log.Debug().Str("path", paths.Config).Msg("Config saved")
+	return nil
+}
+
+// UpdateConfig loads the config, applies fn and saves the result.
+func UpdateConfig(fn func(*Config) error) error {
+	cfg, err := LoadConfig()
+	if err != nil {
+		return err
+	}
+	err = fn(&cfg)
+	if err != nil {
+		return err
+	}
+	return SaveConfig(cfg)
+}
+
+func migrateLegacyConfig() (Config, error) {
+	var cfg Config
+	migrated := []string{}
+	stationID := ""
+
+	ini, err := readINI(paths.LegacyConfig)
+	switch {
+	case err == nil:
+		stationID = ini["ID.station_number"]
+		cfg.PostInstallComplete = ini["Setup.post_install_complete"] == "true"
+		migrated = append(migrated, paths.LegacyConfig)
+	case !os.IsNotExist(err):
+		return cfg, fmt.Errorf("failed to read legacy config: %w", err)
+	}
+
+	if strings.TrimSpace(stationID) == "" {
+		if bytes, err := os.ReadFile(pathLegacyStationID); err == nil {
+			stationID = string(bytes)
+			migrated = append(migrated, pathLegacyStationID)
+		}
+	}
+
+	if len(migrated) == 0 {
+		return cfg, nil
+	}
+
+	// Legacy configs have no station format; a room letter in the ID means the lab uses them
+	match := stationIDPattern.FindStringSubmatch(strings.ToUpper(strings.TrimSpace(stationID)))
+	if match != nil && match[1] != "" {
+		cfg.StationFormat.Alphanumeric = true
+	}
+	err = cfg.Set("station_id", stationID)
+	if err != nil {
+		log.Warn().Err(err).Msg("Dropping the legacy station ID; set a valid one with 'iceslab station set <id>'")
+	}
+
+	err = SaveConfig(cfg)
+	if err != nil {
+		return cfg, fmt.Errorf("failed to save migrated config: %w", err)
+	}
+	for _, path := range migrated {
+		err = MoveFile(path, path+".migrated")
+		if err != nil {
+			log.Warn().Err(err).Str("path", path).Msg("Failed to rename migrated legacy config")
+		}
+	}
+	log.Info().Strs("from", migrated).Str("path", paths.Config).Msg("Migrated legacy station config")
+	return cfg, nil
+}
+
+// readINI flattens a simple INI file into "Section.key" entries.
+func readINI(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	values := map[string]string{}
+	section := ""
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "", strings.HasPrefix(line, "#"), strings.HasPrefix(line, ";"):
+			continue
+		case strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]"):
+			section = strings.TrimSpace(line[1 : len(line)-1])
+		default:
+			key, value, ok := strings.Cut(line, "=")
+			if !ok {
+				continue
+			}
+			values[section+"."+strings.TrimSpace(key)] = strings.TrimSpace(value)
+		}
+	}
+	return values, scanner.Err()
+}
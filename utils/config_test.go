@@ -0,0 +1,65 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMigrateLegacyConfig(t *testing.T) {
+	tests := []struct {
+		name      string
+		ini       string
+		stationID string
+		want      string
+		// alphanumeric is whether the migrated config allows letters in IDs
+		alphanumeric bool
+	}{
+		{"numeric ID is padded", "[ID]\nstation_number = 7\n", "", "07", false},
+		{"room letter is upper-cased and padded", "[ID]\nstation_number = b7\n", "", "B07", true},
+		{"normalized ID is kept", "[ID]\nstation_number = B12\n", "", "B12", true},
+		{"station ID file", "", " 3\n", "03", false},
+		{"INI without an ID falls back to the file", "[Setup]\npost_install_complete = true\n", "b2\n", "B02", true},
+		{"invalid ID is dropped", "[ID]\nstation_number = 7-a\n", "", "", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			saved := paths
+			t.Cleanup(func() { paths = saved })
+			paths = NewPaths(t.TempDir())
+			// The station ID file is read from the working directory
+			t.Chdir(t.TempDir())
+
+			if test.ini != "" {
+				err := os.MkdirAll(filepath.Dir(paths.LegacyConfig), 0755)
+				if err == nil {
+					err = os.WriteFile(paths.LegacyConfig, []byte(test.ini), 0644)
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if test.stationID != "" {
+				err := os.WriteFile(pathLegacyStationID, []byte(test.stationID), 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			cfg, err := LoadConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Load again to read what the migration saved
+			reloaded, err := LoadConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, cfg := range []Config{cfg, reloaded} {
+				if cfg.StationID != test.want || cfg.StationFormat.Alphanumeric != test.alphanumeric {
+					t.Errorf("station_id = %q, alphanumeric %v; want %q, %v", cfg.StationID, cfg.StationFormat.Alphanumeric, test.want, test.alphanumeric)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,291 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"os/user"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	CheckPass = "pass"
+	CheckWarn = "warn"
+	CheckFail = "fail"
+
+	guestUser = "guest"
+)
+
+type CheckResult struct {
+	Name    string `json:"name"`
+	Status  string `json:"status"`
+	Message string `json:"message"`
+	Hint    string `json:"hint,omitempty"`
+}
+
+type DoctorCheck struct {
+	Name string
+	Run  func() CheckResult
+}
+
+// DoctorChecks is the registry run by `iceslab doctor`, in order.
+var DoctorChecks = []DoctorCheck{
+	{Name: "guest_user", Run: checkGuestUser},
+	{Name: "guest_template", Run: checkGuestTemplate},
+	{Name: "sudoers", Run: checkSudoers},
+	{Name: "services", Run: checkServices},
+	{Name: "audio_muted", Run: checkAudioMuted},
+	{Name: "browsers", Run: checkBrowsers},
+	{Name: "selinux_contexts", Run: checkSELinuxContexts},
+	{Name: "disk_space", Run: checkDiskSpace},
+	{Name: "clock_sync", Run: checkClockSync},
+	{Name: "experiment_dns", Run: checkExperimentDNS},
+	{Name: "bookmark_urls", Run: checkBookmarkURLs},
+}
+
+func RunDoctor(checks []DoctorCheck) []CheckResult {
+	results := make([]CheckResult, 0, len(checks))
+	for _, check := range checks {
+		result := check.Run()
+		result.Name = check.Name
+		results = append(results, result)
+	}
+	return results
+}
+
+func PrintCheckResults(w io.Writer, results []CheckResult) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, r := range results {
+		fmt.Fprintf(tw, "[%s]\t%s\t%s\n", strings.ToUpper(r.Status), r.Name, r.Message)
+		if r.Hint != "" && r.Status != CheckPass {
+			fmt.Fprintf(tw, "\t\t-> %s\n", r.Hint)
+		}
+	}
+	return tw.Flush()
+}
+
+func pass(format string, args ...any) CheckResult {
+	return CheckResult{Status: CheckPass, Message: fmt.Sprintf(format, args...)}
+}
+
+func warn(hint string, format string, args ...any) CheckResult {
+	return CheckResult{Status: CheckWarn, Message: fmt.Sprintf(format, args...), Hint: hint}
+}
+
+func fail(hint string, format string, args ...any) CheckResult {
+	return CheckResult{Status: CheckFail, Message: fmt.Sprintf(format, args...), Hint: hint}
+}
+
+func checkGuestUser() CheckResult {
+	_, err := user.Lookup(guestUser)
+	if err != nil {
+		return fail("Run 'sudo iceslab install' or assets/scripts/create_guest_template.sh", "guest user %q does not exist", guestUser)
+	}
+	return pass("guest user %q exists", guestUser)
+}
+
+func checkGuestTemplate() CheckResult {
+	entries, err := os.ReadDir(paths.GuestTemplate)
+	if err != nil {
+		return fail("Run assets/scripts/create_guest_template.sh as root", "guest template %s is missing", paths.GuestTemplate)
+	}
+	if len(entries) == 0 {
+		return warn("Re-run assets/scripts/create_guest_template.sh as root", "guest template %s is empty", paths.GuestTemplate)
+	}
+	return pass("guest template present (%d entries)", len(entries))
+}
+
+func checkSudoers() CheckResult {
+	hint := "Re-run assets/scripts/create_guest_template.sh to recreate " + paths.Sudoers
+	info, err := os.Stat(paths.Sudoers)
+	if err != nil {
+		return fail(hint, "%s is missing", paths.Sudoers)
+	}
+	data, err := os.ReadFile(paths.Sudoers)
+	if err != nil {
+		return warn("Run doctor as root", "cannot read %s: %v", paths.Sudoers, err)
+	}
+	if !strings.Contains(string(data), "/opt/iceslab/iceslab") {
+		return fail(hint, "%s does not allow /opt/iceslab/iceslab", paths.Sudoers)
+	}
+	if info.Mode().Perm() != 0440 {
+		return warn("chmod 0440 "+paths.Sudoers, "%s has mode %o, sudo expects 0440", paths.Sudoers, info.Mode().Perm())
+	}
+	return pass("%s allows the guest to run iceslab", paths.Sudoers)
+}
+
+func checkServices() CheckResult {
+	unit := "guest-session-management.service"
+	state, _ := ShellOutput("systemctl is-enabled " + unit)
+	if state == "" {
+		state = "unknown"
+	}
+	if state != "enabled" {
+		return fail("systemctl enable "+unit, "%s is %q", unit, state)
+	}
+	return pass("%s is enabled", unit)
+}
+
+func checkAudioMuted() CheckResult {
+	command := "wpctl get-volume @DEFAULT_AUDIO_SINK@"
+	// wpctl needs the guest's session bus when doctor runs as root
+	if os.Geteuid() == 0 {
+		guest, err := user.Lookup(guestUser)
+		if err != nil {
+			return warn("Log in as the guest and run doctor again", "cannot check audio without the guest user")
+		}
+		command = fmt.Sprintf("runuser -u %s -- env XDG_RUNTIME_DIR=/run/user/%s %s", guestUser, guest.Uid, command)
+	}
+	out, err := ShellOutput(command)
+	if err != nil {
+		return warn("Check that a guest session with PipeWire is running", "cannot read audio state: %v", err)
+	}
+	if !strings.Contains(out, "[MUTED]") {
+		return fail("wpctl set-mute @DEFAULT_AUDIO_SINK@ 1", "default audio sink is not muted (%s)", out)
+	}
+	return pass("default audio sink is muted")
+}
+
+func checkBrowsers() CheckResult {
+	var missing []string
+	for _, candidates := range [][]string{{"firefox"}, {"chromium-browser", "chromium"}} {
+		found := false
+		for _, name := range candidates {
+			if _, err := exec.LookPath(name); err == nil {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, candidates[0])
+		}
+	}
+	if len(missing) > 0 {
+		return fail("dnf install -y firefox chromium", "missing browsers: %s", strings.Join(missing, ", "))
+	}
+	return pass("firefox and chromium are installed")
+}
+
+func checkSELinuxContexts() CheckResult {
+	mode, err := ShellOutput("getenforce")
+	if err != nil {
+		return pass("SELinux tools not present")
+	}
+	if mode == "Disabled" {
+		return pass("SELinux is disabled")
+	}
+	out, err := ShellOutput("restorecon -n -v -R /home/" + guestUser)
+	if err != nil {
+		return warn("Run doctor as root", "cannot check SELinux contexts: %v", err)
+	}
+	if out != "" {
+		return fail("restorecon -R /home/"+guestUser, "guest home has %d mislabeled paths", len(strings.Split(out, "\n")))
+	}
+	return pass("guest home SELinux contexts are correct (%s)", mode)
+}
+
+func checkDiskSpace() CheckResult {
+	const warnBytes, failBytes = 5 << 30, 1 << 30
+	var stat syscall.Statfs_t
+	err := syscall.Statfs("/", &stat)
+	if err != nil {
+		return warn("", "cannot stat filesystem: %v", err)
+	}
+	free := stat.Bavail * uint64(stat.Bsize)
+	switch {
+	case free < failBytes:
+		return fail("Free space with 'dnf clean all' or by removing old guest data", "only %.1f GiB free on /", float64(free)/(1<<30))
+	case free < warnBytes:
+		return warn("Free space with 'dnf clean all'", "%.1f GiB free on /", float64(free)/(1<<30))
+	}
+	return pass("%.1f GiB free on /", float64(free)/(1<<30))
+}
+
+func checkClockSync() CheckResult {
+	out, err := ShellOutput("timedatectl show -p NTPSynchronized --value")
+	if err != nil {
+		return warn("Check timedatectl status", "cannot read clock sync state: %v", err)
+	}
+	if out != "yes" {
+		return fail("timedatectl set-ntp true", "system clock is not NTP synchronized")
+	}
+	return pass("system clock is NTP synchronized")
+}
+
+func doctorBookmarkURLs() ([]*url.URL, error) {
+	cfg, err := LoadConfig()
+	if err != nil {
+		return nil, err
+	}
+	bookmarks, err := CollectBookmarks(paths.Bookmarks, LookupStation(cfg.StationID))
+	if err != nil {
+		return nil, err
+	}
+	var urls []*url.URL
+	for _, bm := range bookmarks {
+		raw := fmt.Sprintf("%v", bm.URL)
+		if !strings.Contains(raw, "://") {
+			raw = "https://" + raw
+		}
+		u, err := url.Parse(raw)
+		if err != nil || u.Hostname() == "" {
+			continue
+		}
+		urls = append(urls, u)
+	}
+	return urls, nil
+}
+
+func checkExperimentDNS() CheckResult {
+	urls, err := doctorBookmarkURLs()
+	if err != nil {
+		return warn("Run 'iceslab update bookmarks'", "cannot collect bookmarks: %v", err)
+	}
+	var failed []string
+	seen := map[string]bool{}
+	for _, u := range urls {
+		host := u.Hostname()
+		if seen[host] {
+			continue
+		}
+		seen[host] = true
+		if _, err := net.LookupHost(host); err != nil {
+			failed = append(failed, host)
+		}
+	}
+	if len(failed) > 0 {
+		return fail("Check DNS, the proxy and DNS-over-HTTPS settings in assets/browser.yaml", "cannot resolve: %s", strings.Join(failed, ", "))
+	}
+	return pass("%d experiment hosts resolve", len(seen))
+}
+
+func checkBookmarkURLs() CheckResult {
+	urls, err := doctorBookmarkURLs()
+	if err != nil {
+		return warn("Run 'iceslab update bookmarks'", "cannot collect bookmarks: %v", err)
+	}
+	client := &http.Client{Timeout: 5 * time.Second}
+	var failed []string
+	for _, u := range urls {
+		response, err := client.Head(u.String())
+		if err != nil {
+			failed = append(failed, u.Host)
+			continue
+		}
+		response.Body.Close()
+		if response.StatusCode >= 500 {
+			failed = append(failed, fmt.Sprintf("%s (%d)", u.Host, response.StatusCode))
+		}
+	}
+	if len(failed) > 0 {
+		return warn("Check the experiment servers are up before the session", "unreachable bookmarks: %s", strings.Join(failed, ", "))
+	}
+	return pass("%d bookmark URLs reachable", len(urls))
+}
@@ -0,0 +1,322 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// downloadAttempts bounds how often one run resumes a download that broke off.
+const downloadAttempts = 5
+
+var (
+	errDownloadInterrupted = errors.New("download interrupted")
+	errChecksumMismatch    = errors.New("checksum mismatch")
+	errUnverified          = errors.New("no published checksum")
+)
+
+// downloadedFile is a complete download in a temporary file, hashed as it was
+// written. Close removes it.
+type downloadedFile struct {
+	*os.File
+	Size   int64
+	SHA256 string
+	ETag   string
+}
+
+func (d *downloadedFile) Close() error {
+	err := d.File.Close()
+	os.Remove(d.Name())
+	return err
+}
+
+// verify checks the download against a published SHA-256.
+func (d *downloadedFile) verify(name, expected string) error {
+	if d.SHA256 != expected {
+		return fmt.Errorf("%w for %s: got %s, expected %s", errChecksumMismatch, name, d.SHA256, expected)
+	}
+	return nil
+}
+
+// partialDownload is an unfinished download and what is needed to ask for the rest:
+// the URL and the ETag or Last-Modified the first part came with. It is kept across
+// runs, so a download cut off by a reboot or a stopped unit resumes next time.
+type partialDownload struct {
+	path      string
+	URL       string `json:"url"`
+	ETag      string `json:"etag,omitempty"`
+	Validator string `json:"validator,omitempty"`
+}
+
+// downloadDir holds partial downloads. It is state, not part of the install, so it
+// bypasses the effect layer; a dry run uses the system temp directory instead.
+func downloadDir() string {
+	if dryRun {
+		return filepath.Join(os.TempDir(), "iceslab-downloads")
+	}
+	return paths.Downloads
+}
+
+func loadPartial(url string) (*partialDownload, error) {
+	dir := downloadDir()
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create download directory: %w", err)
+	}
+	sum := sha256.Sum256([]byte(url))
+	part := &partialDownload{path: filepath.Join(dir, hex.EncodeToString(sum[:8])+".part")}
+	data, err := os.ReadFile(part.path + ".json")
+	if err == nil && json.Unmarshal(data, part) == nil && part.URL == url {
+		return part, nil
+	}
+	part.discard()
+	part.URL, part.ETag, part.Validator = url, "", ""
+	return part, nil
+}
+
+func (p *partialDownload) save() error {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(p.path+".json", data, 0600)
+}
+
+func (p *partialDownload) discard() {
+	os.Remove(p.path)
+	os.Remove(p.path + ".json")
+}
+
+// download streams url into a temporary file, hashing it on the way, instead of
+// holding it in memory. A download that breaks off is resumed with a Range request,
+// in this run or, if the run is stopped, in the next one. With localETag set, an
+// unchanged file is not downloaded and download returns nil. Progress is shown when
+// stderr is a terminal.
+func (c *Client) download(url, localETag string) (*downloadedFile, error) {
+	part, err := loadPartial(url)
+	if err != nil {
+		return nil, err
+	}
+
+	var sum hash.Hash
+	for attempt := 1; ; attempt++ {
+		var unchanged bool
+		sum, unchanged, err = c.fetchPart(part, localETag)
+		if unchanged {
+			part.discard()
+			return nil, nil
+		}
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, errDownloadInterrupted) || c.ctx.Err() != nil || attempt == downloadAttempts {
+			return nil, err
+		}
+		wait := backoff(attempt)
+		log.Warn().Err(err).Str("url", url).Int("attempt", attempt).Dur("retry_in", wait).Msg("Download interrupted; resuming")
+		err = c.sleep(wait)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	file, err := os.Open(part.path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	os.Remove(part.path + ".json")
+	return &downloadedFile{File: file, Size: info.Size(), SHA256: hex.EncodeToString(sum.Sum(nil)), ETag: part.ETag}, nil
+}
+
+// fetchPart downloads what is missing from the partial file: the rest of it if the
+// server agrees to resume, otherwise all of it. It returns the hash of the whole file.
+func (c *Client) fetchPart(part *partialDownload, localETag string) (hash.Hash, bool, error) {
+	request, err := http.NewRequest(http.MethodGet, part.URL, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	if localETag != "" {
+		request.Header.Set("If-None-Match", localETag)
+	}
+	var offset int64
+	if info, err := os.Stat(part.path); err == nil && part.Validator != "" && info.Size() > 0 {
+		offset = info.Size()
+		request.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		// If the file changed upstream since, the server sends all of it instead
+		request.Header.Set("If-Range", part.Validator)
+	}
+
+	response, err := c.do(request)
+	if err != nil {
+		return nil, false, err
+	}
+	defer response.Body.Close()
+
+	flags := os.O_RDWR | os.O_CREATE
+	switch response.StatusCode {
+	case http.StatusNotModified:
+		return nil, true, nil
+	case http.StatusOK:
+		offset = 0
+		flags |= os.O_TRUNC
+	case http.StatusPartialContent:
+		if start, ok := contentRangeStart(response.Header.Get("Content-Range")); !ok || start != offset {
+			part.discard()
+			return nil, false, fmt.Errorf("%w: server resumed at the wrong offset", errDownloadInterrupted)
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		part.discard()
+		return nil, false, fmt.Errorf("%w: server refused to resume", errDownloadInterrupted)
+	case http.StatusNotFound:
+		return nil, false, fmt.Errorf("%w: %s", errNotFound, part.URL)
+	default:
+		return nil, false, fmt.Errorf("unexpected status code: %d", response.StatusCode)
+	}
+
+	if offset == 0 {
+		part.ETag = response.Header.Get("ETag")
+		part.Validator = part.ETag
+		// If-Range only accepts strong ETags
+		if part.Validator == "" || strings.HasPrefix(part.Validator, "W/") {
+			part.Validator = response.Header.Get("Last-Modified")
+		}
+		err = part.save()
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to save download state: %w", err)
+		}
+	}
+
+	file, err := os.OpenFile(part.path, flags, 0600)
+	if err != nil {
+		return nil, false, err
+	}
+	defer file.Close()
+	sum := sha256.New()
+	if offset > 0 {
+		_, err = io.CopyN(sum, file, offset)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to read partial download: %w", err)
+		}
+	}
+
+	total := int64(-1)
+	if response.ContentLength >= 0 {
+		total = offset + response.ContentLength
+	}
+	progress := newProgress(path.Base(response.Request.URL.Path), offset, total)
+	_, err = io.Copy(io.MultiWriter(file, sum, progress), response.Body)
+	progress.finish()
+	if err != nil {
+		return nil, false, fmt.Errorf("%w: %w", errDownloadInterrupted, err)
+	}
+	if total >= 0 && progress.done != total {
+		return nil, false, fmt.Errorf("%w: got %d of %d bytes", errDownloadInterrupted, progress.done, total)
+	}
+	return sum, false, file.Close()
+}
+
+// contentRangeStart parses the first byte position of "bytes <start>-<end>/<size>".
+func contentRangeStart(value string) (int64, bool) {
+	rest, ok := strings.CutPrefix(value, "bytes ")
+	if !ok {
+		return 0, false
+	}
+	start, _, ok := strings.Cut(rest, "-")
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(start, 10, 64)
+	return n, err == nil
+}
+
+// progress redraws one status line on stderr as a download is written through it.
+// It draws nothing unless stderr is a terminal, so the journal and log files only
+// get the usual log lines.
+type progress struct {
+	name        string
+	done, total int64
+	enabled     bool
+	drawn       time.Time
+}
+
+func newProgress(name string, done, total int64) *progress {
+	return &progress{name: name, done: done, total: total, enabled: isTerminal(os.Stderr)}
+}
+
+func (p *progress) Write(b []byte) (int, error) {
+	p.done += int64(len(b))
+	if p.enabled && time.Since(p.drawn) >= 200*time.Millisecond {
+		p.drawn = time.Now()
+		line := fmt.Sprintf("Downloading %s  %s", p.name, formatBytes(p.done))
+		if p.total > 0 {
+			line += fmt.Sprintf(" / %s  %3d%%", formatBytes(p.total), p.done*100/p.total)
+		}
+		fmt.Fprintf(os.Stderr, "\r\033[K%s", line)
+	}
+	return len(b), nil
+}
+
+func (p *progress) finish() {
+	if p.enabled && !p.drawn.IsZero() {
+		fmt.Fprint(os.Stderr, "\r\033[K")
+	}
+}
+
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MiB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KiB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%d B", n)
+}
+
+// allowUnverified returns an error wrapping errUnverified for what is missing, or nil
+// with a warning when the config sets allow_unverified.
+func allowUnverified(missing string) error {
+	cfg, err := LoadConfig()
+	if err != nil || !cfg.AllowUnverified {
+		return fmt.Errorf("%w: %s; set allow_unverified to install it anyway", errUnverified, missing)
+	}
+	log.Warn().Msg(missing + "; installing unverified since allow_unverified is set")
+	return nil
+}
+
+// publishedHash fetches the `sha256sum` line published next to a release asset as
+// <asset>.sha256. A missing checksum is an error wrapping errUnverified, unless the
+// config opts out with allow_unverified; then it returns "" and the caller goes on
+// unverified.
+func (c *Client) publishedHash(resolution Resolution, asset string) (string, error) {
+	data, _, err := c.fetchIfChanged(c.url(resolution.releaseAssetPath(asset+".sha256")), "")
+	if errors.Is(err, errNotFound) {
+		err = allowUnverified(fmt.Sprintf("release %s publishes no checksum for %s", resolution.Ref, asset))
+		return "", err
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch checksum for %s: %w", asset, err)
+	}
+	expected, ok := parseChecksums(data)[asset]
+	if !ok {
+		return "", fmt.Errorf("%s.sha256 has no checksum for %s", asset, asset)
+	}
+	return expected, nil
+}
@@ -0,0 +1,103 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	EffectWrite    = "write"
+	EffectMove     = "move"
+	EffectCopy     = "copy"
+	EffectRemove   = "remove"
+	EffectMkdir    = "mkdir"
+	EffectChmod    = "chmod"
+	EffectExec     = "exec"
+	EffectSystemd  = "systemd"
+	EffectHostname = "hostname"
+)
+
+// Effect is one change to the station: a file write, a move, a shell command, etc.
+// Every change goes through this layer so that --dry-run can record it instead.
+type Effect struct {
+	Kind   string `json:"kind"`
+	Target string `json:"target"`
+	Detail string `json:"detail,omitempty"`
+}
+
+var (
+	dryRun bool
+	plan   []Effect
+)
+
+func SetDryRun(enabled bool) {
+	dryRun = enabled
+}
+
+func DryRun() bool {
+	return dryRun
+}
+
+// Plan returns the effects recorded so far in dry-run mode.
+func Plan() []Effect {
+	return plan
+}
+
+// planEffect records an effect and reports whether the caller should skip executing it.
+func planEffect(kind, target, detail string) bool {
+	if !dryRun {
+		return false
+	}
+	plan = append(plan, Effect{Kind: kind, Target: target, Detail: detail})
+	log.Debug().Str("kind", kind).Str("target", target).Msg("Dry run: planned effect")
+	return true
+}
+
+func PrintPlan(w io.Writer) error {
+	if len(plan) == 0 {
+		_, err := fmt.Fprintln(w, "Dry run: no changes planned")
+		return err
+	}
+	fmt.Fprintf(w, "Dry run: %d planned changes\n", len(plan))
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for i, effect := range plan {
+		fmt.Fprintf(tw, "%3d.\t%s\t%s\t%s\n", i+1, effect.Kind, effect.Target, effect.Detail)
+	}
+	return tw.Flush()
+}
+
+func shellEffectKind(command string) string {
+	for _, field := range strings.Fields(command) {
+		if field == "systemctl" || strings.HasSuffix(field, "/systemctl") {
+			return EffectSystemd
+		}
+	}
+	return EffectExec
+}
+
+func mkdirAll(path string, perm os.FileMode) error {
+	if planEffect(EffectMkdir, path, fmt.Sprintf("mode %04o", perm)) {
+		return nil
+	}
+	recordCreatedDirs(path)
+	return os.MkdirAll(path, perm)
+}
+
+func removeAll(path string) error {
+	if planEffect(EffectRemove, path, "") {
+		return nil
+	}
+	return os.RemoveAll(path)
+}
+
+func chmod(path string, perm os.FileMode) error {
+	if planEffect(EffectChmod, path, fmt.Sprintf("mode %04o", perm)) {
+		return nil
+	}
+	return os.Chmod(path, perm)
+}
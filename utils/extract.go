@@ -0,0 +1,275 @@
+package utils
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/sys/unix"
+)
+
+// Archive limits. Source, bookmarks and release bundles are a few MiB; these only
+// stop a corrupt or hostile archive from filling the disk. Tests lower them.
+var (
+	maxArchiveEntries        = 20000
+	maxArchiveFileSize int64 = 256 << 20
+	maxArchiveSize     int64 = 1 << 30
+)
+
+var errUnsafeArchive = errors.New("unsafe archive")
+
+// archiveEntry is one entry of an archive. body is only set for regular files.
+type archiveEntry struct {
+	name string
+	mode fs.FileMode
+	size int64
+	body io.Reader
+}
+
+// extractZip replaces dest with the contents of a zip archive, dropping the first
+// strip path components of every entry (1 for a GitHub zipball).
+func extractZip(r io.ReaderAt, size int64, dest string, strip int) error {
+	return extractZipVerified(r, size, dest, strip, nil)
+}
+
+// extractZipVerified is extractZip for an archive with no checksum of its own:
+// verify is given the unpacked tree and must accept it before it replaces dest.
+func extractZipVerified(r io.ReaderAt, size int64, dest string, strip int, verify func(dir string) error) error {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return fmt.Errorf("failed to read zip data: %w", err)
+	}
+
+	i := 0
+	var open io.ReadCloser
+	defer func() {
+		if open != nil {
+			open.Close()
+		}
+	}()
+	next := func() (archiveEntry, error) {
+		if open != nil {
+			open.Close()
+			open = nil
+		}
+		if i == len(zr.File) {
+			return archiveEntry{}, io.EOF
+		}
+		file := zr.File[i]
+		i++
+		entry := archiveEntry{name: file.Name, mode: file.Mode(), size: int64(file.UncompressedSize64)}
+		if entry.mode.IsRegular() {
+			open, err = file.Open()
+			if err != nil {
+				return archiveEntry{}, fmt.Errorf("failed to open zip entry %s: %w", file.Name, err)
+			}
+			entry.body = open
+		}
+		return entry, nil
+	}
+	return extractArchive(dest, strip, next, verify)
+}
+
+// extractArchive unpacks every entry next returns into a staging directory beside
+// dest and then swaps it in, so dest holds either the old tree or the complete new
+// one, never a mix. Symlinks, hardlinks, devices, absolute paths and paths escaping
+// dest are refused, as is a tree verify, if set, rejects. In a dry run the archive is
+// checked but nothing is written.
+func extractArchive(dest string, strip int, next func() (archiveEntry, error), verify func(dir string) error) error {
+	dest = filepath.Clean(dest)
+	staging := ""
+	if !dryRun {
+		err := os.MkdirAll(filepath.Dir(dest), 0755)
+		if err != nil {
+			return fmt.Errorf("failed to create directory for %s: %w", dest, err)
+		}
+		staging, err = os.MkdirTemp(filepath.Dir(dest), "."+filepath.Base(dest)+".staging-")
+		if err != nil {
+			return fmt.Errorf("failed to create staging directory: %w", err)
+		}
+		defer os.RemoveAll(staging)
+		err = os.Chmod(staging, 0755)
+		if err != nil {
+			return err
+		}
+	}
+
+	entries, files := 0, 0
+	var total int64
+	for {
+		entry, err := next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read archive: %w", err)
+		}
+		entries++
+		if entries > maxArchiveEntries {
+			return fmt.Errorf("%w: more than %d entries", errUnsafeArchive, maxArchiveEntries)
+		}
+
+		rel, err := archivePath(entry.name, strip)
+		if err != nil {
+			return err
+		}
+		if rel == "" {
+			continue
+		}
+		target := filepath.Join(staging, rel)
+
+		switch {
+		case entry.mode.IsDir():
+			if dryRun {
+				continue
+			}
+			err = os.MkdirAll(target, 0755)
+			if err != nil {
+				return fmt.Errorf("failed to create directory %s: %w", rel, err)
+			}
+		case entry.mode.IsRegular():
+			if entry.size > maxArchiveFileSize {
+				return fmt.Errorf("%w: %s is larger than %d bytes", errUnsafeArchive, entry.name, maxArchiveFileSize)
+			}
+			written, err := extractFile(target, entry, min(maxArchiveFileSize, maxArchiveSize-total))
+			if err != nil {
+				return err
+			}
+			total += written
+			files++
+		default:
+			return fmt.Errorf("%w: %s is a symlink, link or special file", errUnsafeArchive, entry.name)
+		}
+	}
+
+	if planEffect(EffectWrite, dest, fmt.Sprintf("extract %d files, %d bytes", files, total)) {
+		return nil
+	}
+	if verify != nil {
+		err := verify(staging)
+		if err != nil {
+			return err
+		}
+	}
+	err := swapDir(staging, dest)
+	if err != nil {
+		return fmt.Errorf("failed to move %s into place: %w", dest, err)
+	}
+	log.Debug().Str("path", dest).Int("files", files).Int64("bytes", total).Msg("Archive extracted")
+	return nil
+}
+
+// swapDir puts staging in place of dest. An existing dest is exchanged with staging
+// in a single rename, so it is never missing, and then removed.
+func swapDir(staging, dest string) error {
+	err := unix.Renameat2(unix.AT_FDCWD, staging, unix.AT_FDCWD, dest, unix.RENAME_EXCHANGE)
+	if errors.Is(err, unix.ENOENT) {
+		return os.Rename(staging, dest)
+	}
+	if errors.Is(err, unix.EINVAL) || errors.Is(err, unix.ENOSYS) {
+		// The filesystem cannot exchange
+		return swapDirByRename(staging, dest)
+	}
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(staging)
+}
+
+// swapDirByRename moves dest aside and staging into its place. dest is briefly
+// missing between the two renames, and is put back if the second one fails.
+func swapDirByRename(staging, dest string) error {
+	old := staging + ".old"
+	err := os.Rename(dest, old)
+	if errors.Is(err, os.ErrNotExist) {
+		return os.Rename(staging, dest)
+	}
+	if err != nil {
+		return err
+	}
+	err = os.Rename(staging, dest)
+	if err != nil {
+		return errors.Join(err, os.Rename(old, dest))
+	}
+	return os.RemoveAll(old)
+}
+
+// archivePath turns an entry name into a path relative to the destination, or "" for
+// the directories removed by strip.
+func archivePath(name string, strip int) (string, error) {
+	if strings.HasPrefix(name, "/") || strings.Contains(name, `\`) {
+		return "", fmt.Errorf("%w: absolute or non-portable path %q", errUnsafeArchive, name)
+	}
+	parts := strings.Split(strings.TrimSuffix(name, "/"), "/")
+	for _, part := range parts {
+		if part == ".." {
+			return "", fmt.Errorf("%w: path %q leaves the destination", errUnsafeArchive, name)
+		}
+	}
+	if len(parts) <= strip {
+		return "", nil
+	}
+	rel := filepath.Join(parts[strip:]...)
+	if !filepath.IsLocal(rel) {
+		return "", fmt.Errorf("%w: path %q leaves the destination", errUnsafeArchive, name)
+	}
+	return rel, nil
+}
+
+// extractFile writes one regular file, reading at most limit bytes. In a dry run the
+// content is only read and counted.
+func extractFile(target string, entry archiveEntry, limit int64) (int64, error) {
+	if dryRun {
+		written, err := io.Copy(io.Discard, io.LimitReader(entry.body, limit+1))
+		if err == nil && written > limit {
+			err = fmt.Errorf("%w: %s exceeds the size limit", errUnsafeArchive, entry.name)
+		}
+		return written, err
+	}
+
+	err := os.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create directory for %s: %w", entry.name, err)
+	}
+	perm := archivePerm(entry.mode)
+	// O_EXCL: an archive listing the same file twice is corrupt or crafted
+	file, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if errors.Is(err, fs.ErrExist) {
+		return 0, fmt.Errorf("%w: %s is listed twice", errUnsafeArchive, entry.name)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to create %s: %w", entry.name, err)
+	}
+	defer file.Close()
+
+	written, err := io.Copy(file, io.LimitReader(entry.body, limit+1))
+	if err != nil {
+		return written, fmt.Errorf("failed to extract %s: %w", entry.name, err)
+	}
+	if written > limit {
+		return written, fmt.Errorf("%w: %s exceeds the size limit", errUnsafeArchive, entry.name)
+	}
+	// The umask may have narrowed the mode given to OpenFile
+	err = file.Chmod(perm)
+	if err != nil {
+		return written, err
+	}
+	return written, file.Close()
+}
+
+// archivePerm keeps an entry's permission bits, including the executable bit, but
+// never makes files setuid, setgid or writable by anyone but root. Archives without
+// modes get 0644.
+func archivePerm(mode fs.FileMode) fs.FileMode {
+	perm := mode.Perm() &^ 0022
+	if perm == 0 {
+		return 0644
+	}
+	return perm | 0600
+}
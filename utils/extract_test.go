@@ -0,0 +1,163 @@
+package utils
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// zipEntry is one entry of a crafted zip. size, if set, is the uncompressed size the
+// header claims instead of the length of body.
+type zipEntry struct {
+	name string
+	mode fs.FileMode
+	body string
+	size uint64
+}
+
+func buildZip(t *testing.T, entries []zipEntry) *bytes.Reader {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, entry := range entries {
+		header := &zip.FileHeader{Name: entry.name, Method: zip.Deflate}
+		header.SetMode(entry.mode)
+		var w io.Writer
+		var err error
+		if entry.size != 0 {
+			// Stored raw, so the header keeps the size it claims
+			header.Method = zip.Store
+			header.CompressedSize64 = uint64(len(entry.body))
+			header.UncompressedSize64 = entry.size
+			w, err = zw.CreateRaw(header)
+		} else {
+			w, err = zw.CreateHeader(header)
+		}
+		if err == nil {
+			_, err = io.WriteString(w, entry.body)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := zw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes.NewReader(buf.Bytes())
+}
+
+func TestExtractZip(t *testing.T) {
+	savedEntries, savedFileSize, savedSize := maxArchiveEntries, maxArchiveFileSize, maxArchiveSize
+	t.Cleanup(func() {
+		maxArchiveEntries, maxArchiveFileSize, maxArchiveSize = savedEntries, savedFileSize, savedSize
+	})
+	maxArchiveEntries, maxArchiveFileSize, maxArchiveSize = 8, 1024, 2048
+
+	many := func(n int, size int) []zipEntry {
+		var entries []zipEntry
+		for i := range n {
+			entries = append(entries, zipEntry{name: fmt.Sprintf("top/f%d", i), mode: 0644, body: strings.Repeat("x", size)})
+		}
+		return entries
+	}
+
+	tests := []struct {
+		name    string
+		entries []zipEntry
+		strip   int
+		// want maps each extracted path to its mode; nil expects errUnsafeArchive
+		want map[string]fs.FileMode
+	}{
+		{"plain tree, top directory stripped", []zipEntry{
+			{name: "top/", mode: fs.ModeDir | 0755},
+			{name: "top/a", mode: 0644, body: "a"},
+			{name: "top/dir/b.sh", mode: 0755, body: "b"},
+		}, 1, map[string]fs.FileMode{"a": 0644, "dir/b.sh": 0755}},
+		{"setuid and setgid dropped", []zipEntry{{name: "a", mode: fs.ModeSetuid | fs.ModeSetgid | 0755, body: "a"}}, 0, map[string]fs.FileMode{"a": 0755}},
+		{"group and world write dropped", []zipEntry{{name: "a", mode: 0777, body: "a"}, {name: "b", mode: 0666, body: "b"}}, 0, map[string]fs.FileMode{"a": 0755, "b": 0644}},
+		{"owner can always write", []zipEntry{{name: "a", mode: 0444, body: "a"}, {name: "b", mode: 0400, body: "b"}}, 0, map[string]fs.FileMode{"a": 0644, "b": 0600}},
+		{"no mode", []zipEntry{{name: "a", mode: 0, body: "a"}}, 0, map[string]fs.FileMode{"a": 0644}},
+		{"parent directory", []zipEntry{{name: "../evil", mode: 0644, body: "x"}}, 0, nil},
+		{"parent directory after the stripped one", []zipEntry{{name: "top/../../evil", mode: 0644, body: "x"}}, 1, nil},
+		{"parent directory inside the tree", []zipEntry{{name: "top/dir/../../../evil", mode: 0644, body: "x"}}, 1, nil},
+		{"absolute path", []zipEntry{{name: "/etc/evil", mode: 0644, body: "x"}}, 0, nil},
+		{"backslashes", []zipEntry{{name: `..\evil`, mode: 0644, body: "x"}}, 0, nil},
+		{"symlink out of the tree", []zipEntry{{name: "top/link", mode: fs.ModeSymlink | 0777, body: "../../etc"}}, 1, nil},
+		{"symlink within the tree", []zipEntry{{name: "top/link", mode: fs.ModeSymlink | 0777, body: "a"}}, 1, nil},
+		{"file through a symlink", []zipEntry{
+			{name: "top/link", mode: fs.ModeSymlink | 0777, body: "/etc"},
+			{name: "top/link/evil", mode: 0644, body: "x"},
+		}, 1, nil},
+		{"device", []zipEntry{{name: "top/null", mode: fs.ModeDevice | fs.ModeCharDevice | 0666}}, 1, nil},
+		{"same file twice", []zipEntry{{name: "a", mode: 0644, body: "a"}, {name: "a", mode: 0644, body: "b"}}, 0, nil},
+		{"at the entry limit", many(8, 1), 1, map[string]fs.FileMode{
+			"f0": 0644, "f1": 0644, "f2": 0644, "f3": 0644, "f4": 0644, "f5": 0644, "f6": 0644, "f7": 0644,
+		}},
+		{"over the entry limit", many(9, 1), 1, nil},
+		{"at the file size limit", []zipEntry{{name: "a", mode: 0644, body: strings.Repeat("x", 1024)}}, 0, map[string]fs.FileMode{"a": 0644}},
+		{"over the file size limit", []zipEntry{{name: "a", mode: 0644, body: strings.Repeat("x", 1025)}}, 0, nil},
+		{"header claims more than the file size limit", []zipEntry{{name: "a", mode: 0644, body: "x", size: 1 << 40}}, 0, nil},
+		{"over the total size limit", many(3, 1000), 1, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			dest := filepath.Join(dir, "dest")
+			err := os.MkdirAll(dest, 0755)
+			if err == nil {
+				err = os.WriteFile(filepath.Join(dest, "old"), []byte("old"), 0644)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			zr := buildZip(t, test.entries)
+			err = extractZip(zr, zr.Size(), dest, test.strip)
+			if test.want == nil {
+				if !errors.Is(err, errUnsafeArchive) {
+					t.Fatalf("extractZip = %v, want %v", err, errUnsafeArchive)
+				}
+				test.want = map[string]fs.FileMode{"old": 0644}
+			} else if err != nil {
+				t.Fatalf("extractZip: %v", err)
+			}
+
+			got := map[string]fs.FileMode{}
+			err = filepath.WalkDir(dest, func(path string, entry fs.DirEntry, err error) error {
+				if err != nil || entry.IsDir() {
+					return err
+				}
+				info, err := entry.Info()
+				if err != nil {
+					return err
+				}
+				rel, _ := filepath.Rel(dest, path)
+				got[rel] = info.Mode()
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(test.want) {
+				t.Errorf("extracted %v, want %v", got, test.want)
+			}
+
+			// Nothing is left beside dest, and nothing outside it was written
+			left, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(left) != 1 {
+				t.Errorf("left beside dest: %v", left)
+			}
+		})
+	}
+}
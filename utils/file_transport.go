@@ -0,0 +1,57 @@
+package utils
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// fileTransport serves file:// URLs for mirrors on local disks and USB sticks. It
+// answers If-None-Match with an ETag from the file's size and modification time, so
+// unchanged bookmarks are skipped the same way as against GitHub, and with a
+// Last-Modified time for the staged rollout's soak time.
+type fileTransport struct{}
+
+func (fileTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	response := &http.Response{
+		Proto:      "HTTP/1.0",
+		ProtoMajor: 1,
+		Header:     http.Header{},
+		Request:    request,
+		Body:       http.NoBody,
+	}
+	reply := func(code int) (*http.Response, error) {
+		response.StatusCode = code
+		response.Status = fmt.Sprintf("%d %s", code, http.StatusText(code))
+		return response, nil
+	}
+
+	file, err := os.Open(request.URL.Path)
+	if os.IsNotExist(err) {
+		return reply(http.StatusNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil || info.IsDir() {
+		file.Close()
+		return reply(http.StatusNotFound)
+	}
+
+	etag := fmt.Sprintf(`"%x-%x"`, info.Size(), info.ModTime().UnixNano())
+	response.Header.Set("ETag", etag)
+	response.Header.Set("Last-Modified", info.ModTime().UTC().Format(http.TimeFormat))
+	if strings.Contains(request.Header.Get("If-None-Match"), etag) {
+		file.Close()
+		return reply(http.StatusNotModified)
+	}
+	response.ContentLength = info.Size()
+	if request.Method == http.MethodHead {
+		file.Close()
+	} else {
+		response.Body = file
+	}
+	return reply(http.StatusOK)
+}
@@ -5,53 +5,55 @@ import (
 	"bytes"
 	"fmt"
 	"io"
-	"os"
-	"path/filepath"
-
-	"github.com/rs/zerolog/log"
+	"strings"
 )
 
-func unzipInto(dest string, zipData []byte) error {
-	zr, err := zip.NewReader(bytes.NewReader(zipData), int64(len(zipData)))
+// zipSubtree rebuilds a GitHub zipball as a zip of just dir, without the
+// "<owner>-<repo>-<sha>/" prefix GitHub adds to every entry.
+func zipSubtree(r io.ReaderAt, size int64, dir string) ([]byte, error) {
+	zr, err := zip.NewReader(r, size)
 	if err != nil {
-		return fmt.Errorf("failed to read zip data: %w", err)
+		return nil, fmt.Errorf("failed to read zip data: %w", err)
 	}
 
+	var out bytes.Buffer
+	zw := zip.NewWriter(&out)
+	found := false
 	for _, entry := range zr.File {
-		fullDest := filepath.Join(dest, entry.Name)
-
-		err = os.MkdirAll(filepath.Dir(fullDest), os.ModePerm)
-		if err != nil {
-			return fmt.Errorf("failed to create directory for zip entry: %w", err)
+		_, rel, ok := strings.Cut(entry.Name, "/")
+		if !ok {
+			continue
 		}
-
-		switch entry.FileInfo().IsDir() {
-		case true:
-			err = os.MkdirAll(fullDest, 0755)
-			if err != nil {
-				return fmt.Errorf("failed to create directory: %w", err)
-			}
-			log.Debug().Str("dir", entry.Name).Str("path", fullDest).Msg("Created directory for asset")
+		rel, ok = strings.CutPrefix(rel, dir+"/")
+		if !ok || rel == "" {
 			continue
-		case false:
-			rc, err := entry.Open()
-			if err != nil {
-				return fmt.Errorf("failed to open zip entry: %w", err)
-			}
-			defer rc.Close()
-
-			data, err := io.ReadAll(rc)
-			if err != nil {
-				return fmt.Errorf("failed to read zip entry data: %w", err)
-			}
-
-			err = os.WriteFile(fullDest, data, 0644)
-			if err != nil {
-				return fmt.Errorf("failed to write asset file: %w", err)
-			}
-			log.Debug().Str("file", entry.Name).Str("path", fullDest).Msg("Asset file written")
+		}
+		found = true
+		header := entry.FileHeader
+		header.Name = rel
+		w, err := zw.CreateHeader(&header)
+		if err != nil {
+			return nil, err
+		}
+		if entry.FileInfo().IsDir() {
 			continue
 		}
+		rc, err := entry.Open()
+		if err != nil {
+			return nil, fmt.Errorf("failed to open zip entry: %w", err)
+		}
+		_, err = io.Copy(w, rc)
+		rc.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to copy zip entry: %w", err)
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("%s not found in archive", dir)
+	}
+	err = zw.Close()
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	return out.Bytes(), nil
 }
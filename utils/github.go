@@ -0,0 +1,240 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// EnvGitHubToken overrides the token file, e.g. for a one-off run or in CI.
+const EnvGitHubToken = "ICESLAB_GITHUB_TOKEN"
+
+// rateLimitReserve is how many API requests are left for other stations behind the
+// same address before this one stops asking and falls back to what it has cached.
+const rateLimitReserve = 10
+
+var errRateLimited = errors.New("GitHub API rate limit reached")
+
+// GitHubToken returns the token from $ICESLAB_GITHUB_TOKEN or the token file, or ""
+// to use the API anonymously.
+func GitHubToken() (string, error) {
+	if token := strings.TrimSpace(os.Getenv(EnvGitHubToken)); token != "" {
+		return token, nil
+	}
+	return readSecret(paths.GitHubToken)
+}
+
+// readSecret returns the trimmed contents of a secret file, or "" if there is none.
+// The file must be owned by root and unreadable by anyone else, since any user on a
+// station could otherwise read it.
+func readSecret(name string) (string, error) {
+	info, err := os.Stat(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return "", fmt.Errorf("refusing to use %s: mode %04o, must not be readable by group or others (chmod 600)", name, info.Mode().Perm())
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok && stat.Uid != 0 {
+		return "", fmt.Errorf("refusing to use %s: owned by uid %d, must be owned by root", name, stat.Uid)
+	}
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// githubRepo returns "owner/repo" when the update URL is a repository on github.com,
+// e.g. a fork, whose releases come from the API rather than a mirror's releases.json.
+func (c *Client) githubRepo() (string, bool) {
+	u, err := url.Parse(c.baseURL)
+	if err != nil || u.Host != "github.com" {
+		return "", false
+	}
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if len(parts) != 2 {
+		return "", false
+	}
+	return parts[0] + "/" + parts[1], true
+}
+
+func (c *Client) isAPI(u *url.URL) bool {
+	api, err := url.Parse(c.apiURL)
+	return err == nil && u.Host == api.Host
+}
+
+// authorize adds the token to requests for the GitHub API. Downloads from github.com
+// do not accept a token, so with one set, downloads from the repository are sent
+// through the API instead, which is the only way to reach a private fork's files.
+// Go drops the header when the API redirects to another host.
+func (c *Client) authorize(request *http.Request) error {
+	if c.token == "" {
+		return nil
+	}
+	if repo, ok := c.githubRepo(); ok && request.URL.Host == "github.com" {
+		path, found := strings.CutPrefix(request.URL.Path, "/"+repo+"/")
+		if found {
+			err := c.apiDownload(request, repo, path)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if c.isAPI(request.URL) {
+		request.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	return nil
+}
+
+// apiDownload rewrites a github.com download path (see Resolution) to its API equivalent.
+func (c *Client) apiDownload(request *http.Request, repo, path string) error {
+	repoURL := c.apiURL + "/repos/" + repo
+	parts := strings.SplitN(path, "/", 4)
+	var target string
+	switch {
+	case len(parts) == 2 && parts[0] == "zipball":
+		target = repoURL + "/zipball/" + parts[1]
+	case len(parts) >= 3 && parts[0] == "raw":
+		file := strings.Join(parts[2:], "/")
+		target = repoURL + "/contents/" + file + "?ref=" + url.QueryEscape(parts[1])
+		request.Header.Set("Accept", "application/vnd.github.raw")
+	case len(parts) == 4 && parts[0] == "releases" && parts[1] == "download":
+		asset, err := c.releaseAssetURL(repoURL, parts[2], parts[3])
+		if err != nil {
+			return err
+		}
+		target = asset
+		request.Header.Set("Accept", "application/octet-stream")
+	default:
+		return nil
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return err
+	}
+	request.URL = u
+	request.Host = u.Host
+	return nil
+}
+
+// releaseAssetURL looks up the API URL of a release asset, which, unlike the browser
+// download URL, can be fetched with a token.
+func (c *Client) releaseAssetURL(repoURL, tag, name string) (string, error) {
+	request, err := http.NewRequest(http.MethodGet, repoURL+"/releases/tags/"+url.PathEscape(tag), nil)
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("Accept", "application/vnd.github+json")
+	response, err := c.do(request)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusNotFound {
+		return "", fmt.Errorf("%w: release %s", errNotFound, tag)
+	}
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to look up release %s: status %d", tag, response.StatusCode)
+	}
+	var release struct {
+		Assets []struct {
+			Name string `json:"name"`
+			URL  string `json:"url"`
+		} `json:"assets"`
+	}
+	err = json.NewDecoder(response.Body).Decode(&release)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode release %s: %w", tag, err)
+	}
+	for _, asset := range release.Assets {
+		if asset.Name == name {
+			return asset.URL, nil
+		}
+	}
+	return "", fmt.Errorf("%w: %s in release %s", errNotFound, name, tag)
+}
+
+// RateLimit is the API quota GitHub reported last. Anonymous requests are counted per
+// address, so every station behind the lab's NAT draws on the same 60 per hour.
+type RateLimit struct {
+	Limit     int       `json:"limit"`
+	Remaining int       `json:"remaining"`
+	Reset     time.Time `json:"reset"`
+}
+
+func parseRateLimit(header http.Header) (RateLimit, bool) {
+	limit, err := strconv.Atoi(header.Get("X-RateLimit-Limit"))
+	if err != nil {
+		return RateLimit{}, false
+	}
+	remaining, err := strconv.Atoi(header.Get("X-RateLimit-Remaining"))
+	if err != nil {
+		return RateLimit{}, false
+	}
+	reset, err := strconv.ParseInt(header.Get("X-RateLimit-Reset"), 10, 64)
+	if err != nil {
+		return RateLimit{}, false
+	}
+	return RateLimit{Limit: limit, Remaining: remaining, Reset: time.Unix(reset, 0)}, true
+}
+
+func loadRateLimit() (RateLimit, bool) {
+	data, err := os.ReadFile(paths.RateLimit)
+	if err != nil {
+		return RateLimit{}, false
+	}
+	var limit RateLimit
+	if json.Unmarshal(data, &limit) != nil || time.Now().After(limit.Reset) {
+		return RateLimit{}, false
+	}
+	return limit, true
+}
+
+// recordRateLimit keeps the quota from an API response, so the next run (or the next
+// station logging in) knows how much is left before it asks.
+func recordRateLimit(response *http.Response) {
+	limit, ok := parseRateLimit(response.Header)
+	if !ok {
+		return
+	}
+	log.Debug().Int("limit", limit.Limit).Int("remaining", limit.Remaining).Time("reset", limit.Reset).Msg("GitHub API rate limit")
+	data, err := json.Marshal(limit)
+	if err != nil {
+		return
+	}
+	err = writeFile(paths.RateLimit, data, 0644)
+	if err != nil {
+		log.Debug().Err(err).Msg("Failed to save GitHub API rate limit")
+	}
+}
+
+// rateLimitWait returns how long to hold off before an API request: zero when
+// enough quota is left, otherwise until the quota resets.
+func rateLimitWait() (time.Duration, RateLimit) {
+	limit, ok := loadRateLimit()
+	if !ok || limit.Remaining > rateLimitReserve {
+		return 0, limit
+	}
+	return time.Until(limit.Reset), limit
+}
+
+// rateLimited reports whether a response was refused because the quota ran out.
+func rateLimited(response *http.Response) bool {
+	if response.StatusCode != http.StatusForbidden && response.StatusCode != http.StatusTooManyRequests {
+		return false
+	}
+	return response.Header.Get("X-RateLimit-Remaining") == "0"
+}
@@ -0,0 +1,210 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// UserAgent is sent with every request; main adds the version.
+var UserAgent = "iceslab"
+
+const (
+	connectTimeout = 10 * time.Second
+	// readTimeout is how long a response may stall, waiting for headers or between
+	// body reads, before the request is abandoned. Slow but steady downloads are fine.
+	readTimeout = 30 * time.Second
+
+	maxAttempts   = 5
+	baseBackoff   = time.Second
+	maxBackoff    = 30 * time.Second
+	maxRetryAfter = 2 * time.Minute
+)
+
+func newTransport() *http.Transport {
+	dialer := &net.Dialer{Timeout: connectTimeout, KeepAlive: 30 * time.Second}
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   connectTimeout,
+		ResponseHeaderTimeout: readTimeout,
+		IdleConnTimeout:       90 * time.Second,
+		ForceAttemptHTTP2:     true,
+	}
+	transport.RegisterProtocol("file", fileTransport{})
+	return transport
+}
+
+// do sends the request with the client's context, retrying connection errors and
+// retryable statuses with exponential backoff and full jitter, or after the server's
+// Retry-After. GitHub API requests also wait for the rate limit to reset when it is
+// nearly used up, or fail with errRateLimited when that is too far off. A request
+// body is rewound for every retry; a body that cannot be is sent only once. The
+// caller closes the returned body as usual.
+func (c *Client) do(request *http.Request) (*http.Response, error) {
+	request.Header.Set("User-Agent", UserAgent)
+	err := c.authorize(request)
+	if err != nil {
+		return nil, err
+	}
+	api := c.isAPI(request.URL)
+	for attempt := 1; ; attempt++ {
+		if api {
+			err = c.waitForRateLimit()
+			if err != nil {
+				return nil, err
+			}
+		}
+		ctx, cancel := context.WithCancel(c.ctx)
+		attemptRequest := request.Clone(ctx)
+		if attempt > 1 && request.GetBody != nil {
+			// The previous attempt consumed the body
+			attemptRequest.Body, err = request.GetBody()
+			if err != nil {
+				cancel()
+				return nil, err
+			}
+		}
+		response, err := c.http.Do(attemptRequest)
+		if err == nil && api {
+			recordRateLimit(response)
+		}
+		if err == nil && !retryableStatus(response.StatusCode) && !rateLimited(response) {
+			response.Body = newIdleTimeoutBody(response.Body, cancel)
+			return response, nil
+		}
+
+		wait := backoff(attempt)
+		if err == nil {
+			if after, ok := retryAfter(response.Header.Get("Retry-After")); ok {
+				wait = after
+			}
+			err = fmt.Errorf("server returned %s", response.Status)
+			if limit, ok := parseRateLimit(response.Header); ok && rateLimited(response) {
+				wait = max(time.Until(limit.Reset), wait)
+				err = fmt.Errorf("%w until %s", errRateLimited, limit.Reset.Format(time.TimeOnly))
+			}
+			response.Body.Close()
+		}
+		cancel()
+		if c.ctx.Err() != nil {
+			return nil, c.ctx.Err()
+		}
+		if attempt == maxAttempts || wait > maxRetryAfter || !rewindable(request) {
+			return nil, fmt.Errorf("%s %s failed after %d attempts: %w", request.Method, request.URL.Redacted(), attempt, err)
+		}
+
+		log.Warn().Err(err).Str("url", request.URL.Redacted()).Int("attempt", attempt).Dur("retry_in", wait).Msg("Request failed; retrying")
+		err = c.sleep(wait)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// rewindable reports whether the request can be sent again: it has no body, or one
+// GetBody can produce anew, as http.NewRequest sets up for in-memory bodies.
+func rewindable(request *http.Request) bool {
+	return request.Body == nil || request.Body == http.NoBody || request.GetBody != nil
+}
+
+func (c *Client) sleep(wait time.Duration) error {
+	select {
+	case <-time.After(wait):
+		return nil
+	case <-c.ctx.Done():
+		return c.ctx.Err()
+	}
+}
+
+// waitForRateLimit holds an API request back while the recorded quota is within
+// rateLimitReserve of running out.
+func (c *Client) waitForRateLimit() error {
+	wait, limit := rateLimitWait()
+	if wait <= 0 {
+		return nil
+	}
+	if wait > maxRetryAfter {
+		return fmt.Errorf("%w: %d of %d requests left until %s", errRateLimited, limit.Remaining, limit.Limit, limit.Reset.Format(time.TimeOnly))
+	}
+	log.Warn().Int("remaining", limit.Remaining).Dur("wait", wait).Msg("GitHub API rate limit nearly reached; waiting for it to reset")
+	return c.sleep(wait)
+}
+
+func (c *Client) get(url string) (*http.Response, error) {
+	request, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.do(request)
+}
+
+func retryableStatus(code int) bool {
+	switch code {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests,
+		http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// backoff doubles from baseBackoff up to maxBackoff and picks a random point below
+// it, so stations that failed together do not retry together.
+func backoff(attempt int) time.Duration {
+	ceiling := baseBackoff << (attempt - 1)
+	if ceiling > maxBackoff || ceiling <= 0 {
+		ceiling = maxBackoff
+	}
+	return rand.N(ceiling) + time.Millisecond
+}
+
+// retryAfter parses a Retry-After header given in seconds or as an HTTP date.
+func retryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return max(time.Until(at), 0), true
+	}
+	return 0, false
+}
+
+// idleTimeoutBody cancels the request if no bytes arrive for readTimeout.
+type idleTimeoutBody struct {
+	body   io.ReadCloser
+	timer  *time.Timer
+	cancel context.CancelFunc
+}
+
+var errReadTimeout = errors.New("response stalled")
+
+func newIdleTimeoutBody(body io.ReadCloser, cancel context.CancelFunc) *idleTimeoutBody {
+	return &idleTimeoutBody{body: body, cancel: cancel, timer: time.AfterFunc(readTimeout, cancel)}
+}
+
+func (b *idleTimeoutBody) Read(p []byte) (int, error) {
+	n, err := b.body.Read(p)
+	if !b.timer.Reset(readTimeout) && errors.Is(err, context.Canceled) {
+		return n, fmt.Errorf("%w for %s", errReadTimeout, readTimeout)
+	}
+	return n, err
+}
+
+func (b *idleTimeoutBody) Close() error {
+	b.timer.Stop()
+	err := b.body.Close()
+	b.cancel()
+	return err
+}
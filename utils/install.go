@@ -3,6 +3,7 @@ package utils
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 
 	"github.com/rs/zerolog/log"
 )
@@ -13,34 +14,52 @@ func InstallTo(path string) error {
 	if err != nil {
 		return fmt.Errorf("failed to get executable path: %w", err)
 	}
-	err = MoveFile(execPath, path)
+	dest := filepath.Join(path, "iceslab")
+	err = MoveFile(execPath, dest)
 	if err != nil {
-		return fmt.Errorf("failed to move binary to %s: %w", path, err)
+		return fmt.Errorf("failed to move binary to %s: %w", dest, err)
 	}
 	log.Debug().Msgf("Binary moved to %s successfully", path)
 	return nil
 }
 
-func InstallPackages(installPath string) error {
-	if _, err := os.Stat(installPath + ".post_install"); err == nil {
+// InstallPackages runs the package install script, which reboots the station when it
+// finishes unless noReboot is set.
+func InstallPackages(installPath string, noReboot bool) error {
+	cfg, err := LoadConfig()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+	if cfg.PostInstallComplete {
 		log.Info().Msg("Post-installation already completed; skipping package installation")
 		return nil
 	}
+	if _, err := os.Stat(filepath.Join(installPath, ".post_install")); err == nil {
+		log.Info().Msg("Legacy post-install marker found; recording in config and skipping package installation")
+		return UpdateConfig(func(cfg *Config) error {
+			cfg.PostInstallComplete = true
+			return nil
+		})
+	}
 
 	log.Info().Str("installPath", installPath).Msg("Installing software dependencies")
-	err := RunShellCommand("sudo chmod +x " + installPath + "assets/scripts/install_upgrade_packages.sh")
-	if err != nil {
-		return fmt.Errorf("failed to make software install script executable: %w", err)
+	// DumpAssets writes scripts executable, as the manifest records them
+	script := filepath.Join(installPath, "assets", "scripts", "install_upgrade_packages.sh")
+	command := "sudo " + script
+	if noReboot {
+		command += " --no-reboot"
 	}
-
-	err = RunShellCommand("sudo " + installPath + "assets/scripts/install_upgrade_packages.sh")
+	err = RunShellCommand(command)
 	if err != nil {
 		return fmt.Errorf("failed to run software install script: %w", err)
 	}
 
-	err = os.WriteFile(installPath+".post_install", []byte("completed"), 0644)
+	err = UpdateConfig(func(cfg *Config) error {
+		cfg.PostInstallComplete = true
+		return nil
+	})
 	if err != nil {
-		return fmt.Errorf("failed to write post_install file: %w", err)
+		return fmt.Errorf("failed to record post-install completion: %w", err)
 	}
 
 	log.Info().Msg("Software dependencies installed successfully")
@@ -50,16 +69,29 @@ func InstallPackages(installPath string) error {
 
 func SetupGuestUser(installPath string) error {
 	log.Info().Str("installPath", installPath).Msg("Setting up guest user")
-	err := RunShellCommand("sudo chmod +x " + installPath + "assets/scripts/create_guest_template.sh")
-	if err != nil {
-		return fmt.Errorf("failed to make guest template script executable: %w", err)
-	}
 
-	err = RunShellCommand("sudo " + installPath + "assets/scripts/create_guest_template.sh")
+	// Paths the guest template script creates, checked before and after so the
+	// install record only claims what the script actually created
+	guestTemplate := filepath.Join(installPath, "guest-template")
+	unitFile := filepath.Join(paths.Etc, "systemd", "system", "guest-session-management.service")
+	created := []string{guestTemplate, paths.Sudoers, unitFile}
+	snapshot := SnapshotExternal([]string{guestUser}, created)
+	unitState, _ := ShellOutput("systemctl is-enabled guest-session-management.service")
+
+	script := filepath.Join(installPath, "assets", "scripts", "create_guest_template.sh")
+	err := RunShellCommand("sudo " + script)
 	if err != nil {
 		return fmt.Errorf("failed to run guest template script: %w", err)
 	}
 
+	snapshot.RecordUserIfCreated(guestUser)
+	for _, path := range created {
+		snapshot.RecordPathIfCreated(path)
+	}
+	if unitState != "enabled" {
+		RecordEnabledUnit("guest-session-management.service")
+	}
+
 	log.Info().Msg("Guest user setup completed successfully")
 
 	return nil
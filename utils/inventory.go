@@ -0,0 +1,204 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/rs/zerolog/log"
+	"go.yaml.in/yaml/v4"
+)
+
+const inventoryVersion = 1
+
+// Inventory describes every machine in the lab. It is shipped in assets and
+// refreshed from the inventory-latest release the same way as the bookmarks.
+type Inventory struct {
+	Version  int       `yaml:"version" json:"version"`
+	Stations []Station `yaml:"stations" json:"stations"`
+}
+
+type Station struct {
+	ID       string   `yaml:"id" json:"id"`
+	Hostname string   `yaml:"hostname" json:"hostname"`
+	MACs     []string `yaml:"macs" json:"macs"`
+	Serial   string   `yaml:"serial" json:"serial"`
+	Group    string   `yaml:"group" json:"group"`
+	Seat     string   `yaml:"seat" json:"seat"`
+	Notes    string   `yaml:"notes" json:"notes"`
+}
+
+func LoadInventory(path string) (Inventory, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Inventory{}, err
+	}
+	return ParseInventory(data)
+}
+
+func ParseInventory(data []byte) (Inventory, error) {
+	var inventory Inventory
+	err := yaml.Unmarshal(data, &inventory)
+	if err != nil {
+		return inventory, fmt.Errorf("failed to parse inventory: %w", err)
+	}
+	return inventory, inventory.Validate()
+}
+
+func (inv Inventory) Validate() error {
+	if inv.Version != inventoryVersion {
+		return fmt.Errorf("unsupported inventory version %d (expected %d)", inv.Version, inventoryVersion)
+	}
+	seen := map[string]bool{}
+	for _, station := range inv.Stations {
+		if station.ID == "" {
+			return fmt.Errorf("inventory contains a station without an id")
+		}
+		if seen[station.ID] {
+			return fmt.Errorf("inventory contains duplicate station id %q", station.ID)
+		}
+		seen[station.ID] = true
+	}
+	return nil
+}
+
+func (inv Inventory) ByID(ID string) (Station, bool) {
+	for _, station := range inv.Stations {
+		if station.ID == ID {
+			return station, true
+		}
+	}
+	return Station{}, false
+}
+
+func (inv Inventory) ByHostname(hostname string) (Station, bool) {
+	for _, station := range inv.Stations {
+		if station.Hostname != "" && strings.EqualFold(station.Hostname, hostname) {
+			return station, true
+		}
+	}
+	return Station{}, false
+}
+
+func (inv Inventory) ByMAC(mac string) (Station, bool) {
+	for _, station := range inv.Stations {
+		for _, stationMAC := range station.MACs {
+			if strings.EqualFold(stationMAC, mac) {
+				return station, true
+			}
+		}
+	}
+	return Station{}, false
+}
+
+func (inv Inventory) BySerial(serial string) (Station, bool) {
+	for _, station := range inv.Stations {
+		if station.Serial != "" && station.Serial == serial {
+			return station, true
+		}
+	}
+	return Station{}, false
+}
+
+// LookupStation returns the inventory entry for ID, or a bare Station carrying only
+// the ID when the inventory is missing or does not list it.
+func LookupStation(ID string) Station {
+	inventory, err := LoadInventory(paths.Inventory)
+	if err != nil {
+		log.Debug().Err(err).Msg("Inventory unavailable; using bare station ID")
+		return Station{ID: ID}
+	}
+	station, ok := inventory.ByID(ID)
+	if !ok {
+		log.Warn().Str("station_id", ID).Msg("Station not listed in inventory")
+		return Station{ID: ID}
+	}
+	return station
+}
+
+func PrintInventory(w io.Writer, inventory Inventory) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tHOSTNAME\tGROUP\tSEAT\tSERIAL\tMACS\tNOTES")
+	for _, s := range inventory.Stations {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			s.ID, s.Hostname, s.Group, s.Seat, s.Serial, strings.Join(s.MACs, ","), s.Notes)
+	}
+	return tw.Flush()
+}
+
+func (c *Client) UpdateInventory(resolution Resolution) error {
+	localETagBytes, err := os.ReadFile(paths.InventoryETag)
+	localETag := ""
+	if err == nil {
+		localETag = string(localETagBytes)
+		log.Debug().Str("local_inventory_etag", localETag).Msg("Read local inventory ETag")
+	} else {
+		log.Info().Msg("No local inventory ETag found; treating as first run")
+	}
+
+	data, latestETag, err := c.fetchIfChanged(c.url(resolution.inventoryPath()), localETag)
+	if err != nil {
+		return fmt.Errorf("failed to fetch latest inventory: %w", err)
+	}
+
+	if data == nil {
+		log.Info().Msg("Inventory is up to date; no update needed")
+		return nil
+	}
+
+	_, err = ParseInventory(data)
+	if err != nil {
+		return fmt.Errorf("refusing to install invalid inventory: %w", err)
+	}
+
+	err = writeFile(paths.Inventory, data, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write inventory: %w", err)
+	}
+
+	err = writeFile(paths.InventoryETag, []byte(latestETag), 0644)
+	if err != nil {
+		return fmt.Errorf("failed to save latest inventory ETag: %w", err)
+	}
+
+	log.Info().Str("latest_inventory_etag", latestETag).Msg("Inventory updated and ETag saved locally")
+	return nil
+}
+
+func (c *Client) fetchIfChanged(url string, localETag string) ([]byte, string, error) {
+	// Returns data (nil when unchanged), latest ETag, error.
+	latestETag := localETag
+	request, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, latestETag, err
+	}
+
+	if localETag != "" {
+		request.Header.Set("If-None-Match", localETag)
+	}
+
+	response, err := c.do(request)
+	if err != nil {
+		return nil, latestETag, err
+	}
+	defer response.Body.Close()
+
+	switch response.StatusCode {
+	case http.StatusNotModified:
+		return nil, latestETag, nil
+	case http.StatusOK:
+		data, err := io.ReadAll(response.Body)
+		if err != nil {
+			return nil, latestETag, fmt.Errorf("failed to read response data: %w", err)
+		}
+		latestETag = response.Header.Get("ETag")
+		return data, latestETag, nil
+	case http.StatusNotFound:
+		return nil, latestETag, fmt.Errorf("%w: %s", errNotFound, url)
+	default:
+		return nil, latestETag, fmt.Errorf("unexpected status code: %d", response.StatusCode)
+	}
+}
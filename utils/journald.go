@@ -0,0 +1,130 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/rs/zerolog"
+)
+
+const journalSocket = "/run/systemd/journal/socket"
+
+// journalWriter sends each zerolog event to journald over its native protocol, so
+// every field becomes a journal field (RUN_ID, COMMAND, STATION_ID, ...) that
+// `journalctl -o verbose` shows and `journalctl STATION_ID=07` can filter on.
+type journalWriter struct {
+	conn *net.UnixConn
+}
+
+func openJournal() (*journalWriter, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journalSocket, Net: "unixgram"})
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to journald: %w", err)
+	}
+	return &journalWriter{conn: conn}, nil
+}
+
+func (j *journalWriter) Write(p []byte) (int, error) {
+	return j.WriteLevel(zerolog.NoLevel, p)
+}
+
+func (j *journalWriter) WriteLevel(level zerolog.Level, p []byte) (int, error) {
+	var event map[string]any
+	decoder := json.NewDecoder(bytes.NewReader(p))
+	decoder.UseNumber()
+	err := decoder.Decode(&event)
+	if err != nil {
+		return 0, fmt.Errorf("failed to decode log event: %w", err)
+	}
+
+	var buf bytes.Buffer
+	writeJournalField(&buf, "SYSLOG_IDENTIFIER", "iceslab")
+	writeJournalField(&buf, "PRIORITY", journalPriority(level))
+	if message, ok := event[zerolog.MessageFieldName].(string); ok {
+		writeJournalField(&buf, "MESSAGE", message)
+	}
+	for key, value := range event {
+		switch key {
+		case zerolog.MessageFieldName, zerolog.LevelFieldName, zerolog.TimestampFieldName:
+			// journald records its own timestamp, and the level is PRIORITY
+			continue
+		}
+		writeJournalField(&buf, journalFieldName(key), journalValue(value))
+	}
+
+	_, err = j.conn.Write(buf.Bytes())
+	if err != nil {
+		return 0, fmt.Errorf("failed to write to journald: %w", err)
+	}
+	return len(p), nil
+}
+
+func (j *journalWriter) Close() error {
+	return j.conn.Close()
+}
+
+// writeJournalField encodes one field; values containing newlines use the
+// length-prefixed binary form of the protocol.
+func writeJournalField(buf *bytes.Buffer, name, value string) {
+	buf.WriteString(name)
+	if !strings.Contains(value, "\n") {
+		buf.WriteByte('=')
+		buf.WriteString(value)
+		buf.WriteByte('\n')
+		return
+	}
+	buf.WriteByte('\n')
+	_ = binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	buf.WriteString(value)
+	buf.WriteByte('\n')
+}
+
+// journalFieldName maps a zerolog key to a valid journal field name: upper case
+// letters, digits and underscores, not starting with a digit or underscore.
+func journalFieldName(key string) string {
+	name := []byte(strings.ToUpper(key))
+	for i, c := range name {
+		if (c < 'A' || c > 'Z') && (c < '0' || c > '9') {
+			name[i] = '_'
+		}
+	}
+	if len(name) == 0 || name[0] == '_' || (name[0] >= '0' && name[0] <= '9') {
+		return "X_" + string(name)
+	}
+	return string(name)
+}
+
+func journalValue(value any) string {
+	if s, ok := value.(string); ok {
+		return s
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(data)
+}
+
+// journalPriority maps zerolog levels to syslog priorities.
+func journalPriority(level zerolog.Level) string {
+	switch level {
+	case zerolog.TraceLevel, zerolog.DebugLevel:
+		return "7"
+	case zerolog.InfoLevel, zerolog.NoLevel:
+		return "6"
+	case zerolog.WarnLevel:
+		return "4"
+	case zerolog.ErrorLevel:
+		return "3"
+	case zerolog.FatalLevel:
+		return "2"
+	case zerolog.PanicLevel:
+		return "0"
+	default:
+		return "5"
+	}
+}
@@ -0,0 +1,71 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// updateLockWait bounds how long an update waits for another one to finish.
+const updateLockWait = 5 * time.Minute
+
+var ErrUpdateLocked = errors.New("another iceslab update is running")
+
+// LockUpdates takes the lock that keeps the agent, the login-triggered bookmarks
+// update and manual updates from running at the same time. With wait unset it fails
+// with ErrUpdateLocked instead of waiting. The lock is a flock, so it is released even
+// when the process is killed. Dry runs change nothing and so take no lock.
+func LockUpdates(ctx context.Context, wait bool) (unlock func(), err error) {
+	if dryRun {
+		return func() {}, nil
+	}
+	// The lock lives under /run, which is not part of the install, so it bypasses the effect layer
+	err = os.MkdirAll(filepath.Dir(paths.UpdateLock), 0755)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create lock directory: %w", err)
+	}
+	file, err := os.OpenFile(paths.UpdateLock, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open update lock: %w", err)
+	}
+
+	deadline := time.Now().Add(updateLockWait)
+	for logged := false; ; logged = true {
+		err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, syscall.EWOULDBLOCK) {
+			file.Close()
+			return nil, fmt.Errorf("failed to lock %s: %w", paths.UpdateLock, err)
+		}
+		if !wait {
+			file.Close()
+			return nil, ErrUpdateLocked
+		}
+		if time.Now().After(deadline) {
+			file.Close()
+			return nil, fmt.Errorf("%w; gave up after %s", ErrUpdateLocked, updateLockWait)
+		}
+		if !logged {
+			log.Info().Str("lock", paths.UpdateLock).Msg("Waiting for another update to finish")
+		}
+		select {
+		case <-time.After(500 * time.Millisecond):
+		case <-ctx.Done():
+			file.Close()
+			return nil, ctx.Err()
+		}
+	}
+
+	return func() {
+		_ = syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+		file.Close()
+	}, nil
+}
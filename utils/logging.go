@@ -0,0 +1,240 @@
+package utils
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"go.yaml.in/yaml/v4"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	EnvLog = "ICESLAB_LOG"
+
+	LogConsole  = "console"
+	LogJSON     = "json"
+	LogFile     = "file"
+	LogJournald = "journald"
+)
+
+// LogOutputs lists the values accepted by -log, $ICESLAB_LOG and 'log' in the config.
+func LogOutputs() []string {
+	return []string{LogConsole, LogJSON, LogFile, LogJournald}
+}
+
+// logState holds the open outputs and the fields attached to every line, so the
+// logger can be rebuilt when a field changes or the console moves to stderr.
+var logState = struct {
+	outputs []string
+	stderr  bool
+	writer  io.Writer
+	closers []io.Closer
+	warned  bool
+	fields  []string
+	values  map[string]string
+}{values: map[string]string{}}
+
+// ConfigureLogging sends log lines to a comma-separated list of outputs. An empty list falls back to
+// $ICESLAB_LOG, then to 'log' in the config, then to journald when running under
+// systemd and the console otherwise. Every line carries a run ID.
+func ConfigureLogging(list string) error {
+	outputs, source := splitList(list), "flag"
+	if len(outputs) == 0 {
+		outputs, source = splitList(os.Getenv(EnvLog)), "env"
+	}
+	if len(outputs) == 0 {
+		outputs, source = configuredLogOutputs(), "config"
+	}
+	if len(outputs) == 0 {
+		outputs, source = []string{LogConsole}, "default"
+		// systemd sets JOURNAL_STREAM when stdout or stderr is connected to the journal
+		if os.Getenv("JOURNAL_STREAM") != "" {
+			outputs = []string{LogJournald}
+		}
+	}
+	for _, output := range outputs {
+		if !slices.Contains(LogOutputs(), output) {
+			return fmt.Errorf("unknown log output %q (known outputs: %s)", output, strings.Join(LogOutputs(), ", "))
+		}
+	}
+
+	logState.outputs = outputs
+	if _, ok := logState.values["run_id"]; !ok {
+		logState.fields = append(logState.fields, "run_id")
+		logState.values["run_id"] = newRunID()
+	}
+	openLogOutputs()
+	log.Debug().Strs("outputs", outputs).Str("source", source).Msg("Configured logging")
+	return nil
+}
+
+// InitLogging logs to the console until ConfigureLogging has the flags and config.
+func InitLogging() {
+	logState.outputs = []string{LogConsole}
+	openLogOutputs()
+}
+
+// LogToStderr moves console and JSON output to stderr, for commands whose stdout is
+// read by scripts.
+func LogToStderr() {
+	if logState.stderr {
+		return
+	}
+	logState.stderr = true
+	openLogOutputs()
+}
+
+// SetLogField adds or replaces a field that is attached to every following log line,
+// e.g. the subcommand or the station ID once it is known.
+func SetLogField(key, value string) {
+	if _, ok := logState.values[key]; !ok {
+		logState.fields = append(logState.fields, key)
+	}
+	logState.values[key] = value
+	applyLogFields()
+}
+
+// CloseLogging flushes and closes the file and journald outputs.
+func CloseLogging() {
+	for _, closer := range logState.closers {
+		_ = closer.Close()
+	}
+	logState.closers = nil
+}
+
+func openLogOutputs() {
+	CloseLogging()
+	stdout := io.Writer(os.Stdout)
+	if logState.stderr {
+		stdout = os.Stderr
+	}
+
+	var writers []io.Writer
+	var failures []error
+	for _, output := range logState.outputs {
+		switch output {
+		case LogConsole:
+			writers = append(writers, consoleWriter(stdout))
+		case LogJSON:
+			writers = append(writers, stdout)
+		case LogFile:
+			file, err := openRotatingFile(paths.LogFile, logFileMaxSize, logFileKeep)
+			if err != nil {
+				failures = append(failures, err)
+				continue
+			}
+			writers = append(writers, file)
+			logState.closers = append(logState.closers, file)
+		case LogJournald:
+			journal, err := openJournal()
+			if err != nil {
+				failures = append(failures, err)
+				continue
+			}
+			writers = append(writers, journal)
+			logState.closers = append(logState.closers, journal)
+		}
+	}
+	// Never lose log lines entirely because an output is unavailable
+	if len(writers) == 0 {
+		writers = append(writers, consoleWriter(os.Stderr))
+	}
+	logState.writer = zerolog.MultiLevelWriter(writers...)
+	applyLogFields()
+
+	// Reopening for LogToStderr would otherwise repeat the same warnings
+	if logState.warned {
+		return
+	}
+	logState.warned = len(failures) > 0
+	for _, err := range failures {
+		log.Warn().Err(err).Msg("Log output unavailable")
+	}
+}
+
+func applyLogFields() {
+	if logState.writer == nil {
+		return
+	}
+	logger := zerolog.New(logState.writer).With().Timestamp()
+	for _, key := range logState.fields {
+		if value := logState.values[key]; value != "" {
+			logger = logger.Str(key, value)
+		}
+	}
+	log.Logger = logger.Logger()
+}
+
+// consoleWriter only colours output for a terminal, so unit output captured by the
+// journal stays free of escape codes.
+func consoleWriter(w io.Writer) zerolog.ConsoleWriter {
+	return zerolog.ConsoleWriter{Out: w, TimeFormat: time.RFC3339, NoColor: !isTerminal(w)}
+}
+
+// isTerminal asks for the terminal attributes rather than checking for a character
+// device, which /dev/null, the stdin of systemd units, is too.
+func isTerminal(w io.Writer) bool {
+	file, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	_, err := unix.IoctlGetTermios(int(file.Fd()), unix.TCGETS)
+	return err == nil
+}
+
+func newRunID() string {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// ConfiguredStationID reads the station ID from the config without migrating or
+// resolving anything, so it can be attached to log lines before a command runs.
+func ConfiguredStationID() string {
+	data, err := os.ReadFile(paths.Config)
+	if err != nil {
+		return ""
+	}
+	var cfg struct {
+		StationID string `yaml:"station_id"`
+	}
+	if yaml.Unmarshal(data, &cfg) != nil {
+		return ""
+	}
+	return cfg.StationID
+}
+
+func configuredLogOutputs() []string {
+	data, err := os.ReadFile(paths.Config)
+	if err != nil {
+		return nil
+	}
+	var cfg struct {
+		Log []string `yaml:"log"`
+	}
+	if yaml.Unmarshal(data, &cfg) != nil {
+		return nil
+	}
+	return cfg.Log
+}
+
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -1,33 +1,132 @@
 package utils
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	"net/http"
+	"io"
+	"io/fs"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 
 	"go.yaml.in/yaml/v4"
 )
 
+const manifestVersion = 2
+
+// manifestAsset is the assets manifest, attached to every release and kept at the
+// top of the repository.
+const manifestAsset = "manifest.yaml"
+
+// AssetMode is the mode DumpAssets gives an asset: scripts are executable, since
+// install runs them directly, and everything else is 0644.
+func AssetMode(name string) fs.FileMode {
+	if strings.HasSuffix(name, ".sh") {
+		return 0755
+	}
+	return 0644
+}
+
+// Manifest lists every asset with its hash, size and mode, so an install can be
+// checked file by file. Paths are slash-separated and relative to the assets directory.
 type Manifest struct {
-	BinaryHash string `yaml:"binary_hash" json:"binary_hash"`
-	AssetsHash string `yaml:"assets_hash" json:"assets_hash"`
+	ManifestVersion int            `yaml:"manifest_version" json:"manifest_version"`
+	Version         string         `yaml:"version" json:"version"`
+	Commit          string         `yaml:"commit,omitempty" json:"commit,omitempty"`
+	Files           []ManifestFile `yaml:"files" json:"files"`
+}
+
+type ManifestFile struct {
+	Path string `yaml:"path" json:"path"`
+	Hash string `yaml:"sha256" json:"sha256"`
+	Size int64  `yaml:"size" json:"size"`
+	Mode string `yaml:"mode" json:"mode"`
 }
 
-func GenerateManifest() (Manifest, error) {
-	binaryHash, err := HashFile("iceslab")
+// GenerateManifest hashes every regular file in fsys. When modeFor is set, the mode
+// it gives each file is recorded instead of the mode in fsys, e.g. AssetMode for the
+// embedded assets, which have no modes of their own.
+func GenerateManifest(fsys fs.FS, version, commit string, modeFor func(name string) fs.FileMode) (Manifest, error) {
+	manifest := Manifest{ManifestVersion: manifestVersion, Version: version, Commit: commit}
+	err := fs.WalkDir(fsys, ".", func(name string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return fmt.Errorf("%s is not a regular file", name)
+		}
+		file, err := manifestEntry(fsys, name)
+		if err != nil {
+			return err
+		}
+		fileMode := info.Mode().Perm()
+		if modeFor != nil {
+			fileMode = modeFor(name)
+		}
+		file.Mode = formatMode(fileMode)
+		manifest.Files = append(manifest.Files, file)
+		return nil
+	})
 	if err != nil {
-		binaryHash = "error"
+		return manifest, fmt.Errorf("failed to generate manifest: %w", err)
 	}
+	sort.Slice(manifest.Files, func(i, j int) bool {
+		return manifest.Files[i].Path < manifest.Files[j].Path
+	})
+	return manifest, nil
+}
 
-	assetsHash, err := HashDirectory("assets")
+func manifestEntry(fsys fs.FS, name string) (ManifestFile, error) {
+	file, err := fsys.Open(name)
 	if err != nil {
-		assetsHash = "error"
+		return ManifestFile{}, err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return ManifestFile{}, err
+	}
+	return ManifestFile{Path: name, Hash: hex.EncodeToString(hash.Sum(nil)), Size: size}, nil
+}
+
+func formatMode(mode fs.FileMode) string {
+	return fmt.Sprintf("%04o", mode.Perm())
+}
+
+// AssetsHash combines the file hashes the same way HashDirectory does, so a manifest
+// can be compared against a directory without listing it.
+func (m Manifest) AssetsHash() string {
+	files := append([]ManifestFile(nil), m.Files...)
+	sort.Slice(files, func(i, j int) bool {
+		return filepath.FromSlash(files[i].Path) < filepath.FromSlash(files[j].Path)
+	})
+	combined := sha256.New()
+	for _, file := range files {
+		combined.Write([]byte(filepath.FromSlash(file.Path)))
+		combined.Write([]byte(file.Hash))
 	}
+	return hex.EncodeToString(combined.Sum(nil))
+}
 
-	return Manifest{
-		BinaryHash: binaryHash,
-		AssetsHash: assetsHash,
-	}, nil
+func (m Manifest) File(name string) (ManifestFile, bool) {
+	for _, file := range m.Files {
+		if file.Path == name {
+			return file, true
+		}
+	}
+	return ManifestFile{}, false
 }
 
 func SaveManifest(manifest Manifest, path string) error {
@@ -35,44 +134,136 @@ func SaveManifest(manifest Manifest, path string) error {
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(path, data, 0644)
+	return writeFile(path, data, 0644)
 }
 
 func LoadManifest(path string) (Manifest, error) {
-	var manifest Manifest
 	data, err := os.ReadFile(path)
 	if err != nil {
-		return manifest, err
+		return Manifest{}, err
+	}
+	return ParseManifest(data)
+}
+
+func ParseManifest(data []byte) (Manifest, error) {
+	var manifest Manifest
+	err := yaml.Unmarshal(data, &manifest)
+	if err != nil {
+		return manifest, fmt.Errorf("failed to parse manifest: %w", err)
+	}
+	switch manifest.ManifestVersion {
+	case manifestVersion:
+		return manifest, nil
+	case 0:
+		return manifest, errors.New("manifest has no per-file entries (version 1); regenerate it with 'iceslab manifest generate'")
+	default:
+		return manifest, fmt.Errorf("unsupported manifest version %d", manifest.ManifestVersion)
 	}
-	err = yaml.Unmarshal(data, &manifest)
-	return manifest, err
 }
 
-func FetchRemoteManifest() (Manifest, error) {
+// ManifestDiff lists how a directory differs from a manifest.
+type ManifestDiff struct {
+	Missing  []string       `json:"missing"`
+	Modified []ModifiedFile `json:"modified"`
+	Extra    []string       `json:"extra"`
+}
 
-	client := &http.Client{}
-	req, _ := http.NewRequest(
-		"GET",
-		fmt.Sprintf("https://raw.githubusercontent.com/%s/%s/%s/manifest.yaml", owner, repo, branch),
-		nil,
-	)
-	req.Header.Set("User-Agent", "iceslab-config-setup-script")
+type ModifiedFile struct {
+	Path    string   `json:"path"`
+	Changes []string `json:"changes"`
+}
 
-	resp, err := client.Do(req)
-	if err != nil {
-		return Manifest{}, err
+func (d ManifestDiff) Clean() bool {
+	return len(d.Missing) == 0 && len(d.Modified) == 0 && len(d.Extra) == 0
+}
+
+// VerifyManifest compares every file under dir against the manifest by hash, size
+// and mode. The browser policies are rewritten in place whenever bookmarks are
+// applied, so only their presence and mode are checked. The bookmarks and inventory
+// are replaced by their own updates and not checked at all.
+func VerifyManifest(manifest Manifest, dir string) (ManifestDiff, error) {
+	generated := map[string]bool{}
+	for _, policy := range []string{paths.FirefoxPolicies, paths.ChromiumPolicies} {
+		if rel, err := filepath.Rel(paths.Assets, policy); err == nil {
+			generated[filepath.ToSlash(rel)] = true
+		}
+	}
+	var updated []string
+	for _, managed := range []string{paths.Bookmarks, paths.Inventory} {
+		if rel, err := filepath.Rel(paths.Assets, managed); err == nil && filepath.IsLocal(rel) {
+			updated = append(updated, filepath.ToSlash(rel))
+		}
+	}
+	isUpdated := func(name string) bool {
+		for _, managed := range updated {
+			if name == managed || strings.HasPrefix(name, managed+"/") {
+				return true
+			}
+		}
+		return false
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return Manifest{}, fmt.Errorf("failed to fetch remote manifest: status %d", resp.StatusCode)
+	diff := ManifestDiff{Missing: []string{}, Modified: []ModifiedFile{}, Extra: []string{}}
+	actual, err := GenerateManifest(os.DirFS(dir), "", "", nil)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return diff, err
 	}
 
-	var manifest Manifest
-	err = yaml.NewDecoder(resp.Body).Decode(&manifest)
-	if err != nil {
-		return Manifest{}, err
+	seen := map[string]bool{}
+	for _, file := range actual.Files {
+		seen[file.Path] = true
+		if isUpdated(file.Path) {
+			continue
+		}
+		expected, ok := manifest.File(file.Path)
+		if !ok {
+			diff.Extra = append(diff.Extra, file.Path)
+			continue
+		}
+		var changes []string
+		if file.Hash != expected.Hash && !generated[file.Path] {
+			changes = append(changes, "hash")
+		}
+		if file.Size != expected.Size && !generated[file.Path] {
+			changes = append(changes, "size "+strconv.FormatInt(expected.Size, 10)+" -> "+strconv.FormatInt(file.Size, 10))
+		}
+		if file.Mode != expected.Mode {
+			changes = append(changes, "mode "+expected.Mode+" -> "+file.Mode)
+		}
+		if len(changes) > 0 {
+			diff.Modified = append(diff.Modified, ModifiedFile{Path: file.Path, Changes: changes})
+		}
+	}
+	for _, file := range manifest.Files {
+		if !seen[file.Path] && !isUpdated(file.Path) {
+			diff.Missing = append(diff.Missing, file.Path)
+		}
 	}
+	return diff, nil
+}
 
-	return manifest, nil
+// PrintManifestDiff writes one line per differing file, e.g. "modified  scripts/x.sh  (hash, mode 0644 -> 0755)".
+func PrintManifestDiff(w io.Writer, diff ManifestDiff) {
+	for _, name := range diff.Missing {
+		fmt.Fprintf(w, "missing   %s\n", name)
+	}
+	for _, file := range diff.Modified {
+		fmt.Fprintf(w, "modified  %s  (%s)\n", file.Path, strings.Join(file.Changes, ", "))
+	}
+	for _, name := range diff.Extra {
+		fmt.Fprintf(w, "extra     %s\n", name)
+	}
+}
+
+// FetchRemoteManifest fetches the assets manifest of a release, or of a commit's tree.
+func (c *Client) FetchRemoteManifest(resolution Resolution) (Manifest, error) {
+	path := resolution.releaseAssetPath(manifestAsset)
+	if resolution.IsCommit {
+		path = resolution.rawPath(manifestAsset)
+	}
+	data, _, err := c.fetchIfChanged(c.url(path), "")
+	if err != nil {
+		return Manifest{}, fmt.Errorf("failed to fetch remote manifest: %w", err)
+	}
+	return ParseManifest(data)
 }
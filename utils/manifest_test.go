@@ -0,0 +1,64 @@
+package utils
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestVerifyAfterInstall dumps the repository's assets the way install does and
+// expects verify to find them exactly as the embedded manifest describes.
+func TestVerifyAfterInstall(t *testing.T) {
+	repo := os.DirFS("..")
+	assets, err := fs.Sub(repo, "assets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := GenerateManifest(assets, "test", "", AssetMode)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		// before runs ahead of the install, e.g. to leave assets of an earlier one
+		before func(t *testing.T)
+	}{
+		{"fresh install", func(t *testing.T) {}},
+		{"scripts left 0644 by an earlier install", func(t *testing.T) {
+			script := filepath.Join(paths.Assets, "scripts", "install_upgrade_packages.sh")
+			data, err := fs.ReadFile(assets, "scripts/install_upgrade_packages.sh")
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = os.MkdirAll(filepath.Dir(script), 0755)
+			if err == nil {
+				err = os.WriteFile(script, data, 0644)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			saved := paths
+			t.Cleanup(func() { paths = saved })
+			paths = NewPaths(t.TempDir())
+
+			test.before(t)
+			err := DumpAssets(repo, "assets", paths.Assets)
+			if err != nil {
+				t.Fatal(err)
+			}
+			diff, err := VerifyManifest(manifest, paths.Assets)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !diff.Clean() {
+				t.Errorf("verify after install: missing %v, modified %v, extra %v", diff.Missing, diff.Modified, diff.Extra)
+			}
+		})
+	}
+}
@@ -0,0 +1,273 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+var errNotFound = errors.New("not found")
+
+// rollingReleases are re-published in place by the bookmarks and inventory workflows.
+var rollingReleases = map[string][]string{
+	"bookmarks-latest": {"bookmarks.zip", "bookmarks.zip.sha256"},
+	"bookmarks-beta":   {"bookmarks.zip", "bookmarks.zip.sha256"},
+	"inventory-latest": {"inventory.yaml"},
+	"inventory-beta":   {"inventory.yaml"},
+}
+
+// releaseExtras are attached to every v* release next to the binaries in SHA256SUMS.
+var releaseExtras = []string{manifestAsset, sourceManifestAsset, "bookmarks.zip", "bookmarks.zip.sha256", "inventory.yaml"}
+
+// MirrorSync downloads everything stations need into dir, in the layout the update
+// URL expects: the current stable and beta releases, the rolling bookmarks and
+// inventory releases, and any extra tags or commits stations are pinned to. Serve dir
+// with any web server, or point update_url at it directly. A non-empty pin lists only
+// that release, so the stable and beta channels both resolve to it.
+func (c *Client) MirrorSync(dir string, refs []string, pin string) error {
+	m := mirror{client: c, dir: dir}
+
+	releases, err := c.listReleases()
+	if err != nil {
+		return fmt.Errorf("failed to list releases: %w", err)
+	}
+	var mirrored []githubRelease
+	for _, channel := range []string{ChannelStable, ChannelBeta} {
+		for _, release := range releases {
+			if release.Draft || !strings.HasPrefix(release.TagName, "v") || (release.Prerelease && channel == ChannelStable) {
+				continue
+			}
+			mirrored = appendRelease(mirrored, release)
+			break
+		}
+	}
+
+	var commits []string
+	for _, ref := range refs {
+		err = ValidateChannel(ref)
+		if err != nil {
+			return err
+		}
+		if commitPattern.MatchString(ref) {
+			commits = append(commits, ref)
+			continue
+		}
+		found := false
+		for _, release := range releases {
+			if release.TagName == ref {
+				mirrored = appendRelease(mirrored, release)
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("no release tagged %s", ref)
+		}
+	}
+
+	for _, release := range mirrored {
+		err = m.syncRelease(release.TagName)
+		if err != nil {
+			return fmt.Errorf("failed to mirror %s: %w", release.TagName, err)
+		}
+	}
+	for tag, assets := range rollingReleases {
+		for _, asset := range assets {
+			err = m.optional(releaseAssetPath(tag, asset))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for _, commit := range commits {
+		resolution := Resolution{Channel: commit, Ref: commit, IsCommit: true}
+		err = m.file(resolution.zipballPath())
+		if err == nil {
+			err = m.file(resolution.inventoryPath())
+		}
+		if err != nil {
+			return fmt.Errorf("failed to mirror commit %s: %w", commit, err)
+		}
+	}
+
+	// Listed in upstream order, so beta resolves on the mirror as it does upstream
+	var listed []githubRelease
+	for _, release := range releases {
+		for _, r := range mirrored {
+			if r.TagName == release.TagName && (pin == "" || r.TagName == pin) {
+				listed = append(listed, release)
+			}
+		}
+	}
+	if pin != "" && len(listed) == 0 {
+		return fmt.Errorf("pinned release %s was not mirrored", pin)
+	}
+	data, err := json.MarshalIndent(listed, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Stations may be reading the list while it is replaced
+	err = writeFileAtomic(filepath.Join(dir, releasesListPath), data, 0644)
+	if err != nil {
+		return err
+	}
+
+	log.Info().Str("dir", dir).Int("releases", len(mirrored)).Int("commits", len(commits)).
+		Int("downloaded", m.downloaded).Int("unchanged", m.unchanged).Msg("Mirror synced")
+	return nil
+}
+
+func appendRelease(releases []githubRelease, release githubRelease) []githubRelease {
+	for _, r := range releases {
+		if r.TagName == release.TagName {
+			return releases
+		}
+	}
+	return append(releases, release)
+}
+
+type mirror struct {
+	client     *Client
+	dir        string
+	downloaded int
+	unchanged  int
+}
+
+// syncRelease mirrors the binaries listed in SHA256SUMS, skipping any already present
+// with the right hash, plus the release's other assets and its source zipball.
+func (m *mirror) syncRelease(tag string) error {
+	sumsPath := releaseAssetPath(tag, checksumsAsset)
+	sums, _, err := m.client.fetchIfChanged(m.client.url(sumsPath), "")
+	if err != nil {
+		return err
+	}
+	for name, hash := range parseChecksums(sums) {
+		path := releaseAssetPath(tag, name)
+		if local, err := HashFile(m.local(path)); err == nil && local == hash {
+			m.unchanged++
+			continue
+		}
+		binary, err := m.client.download(m.client.url(path), "")
+		if err != nil {
+			return err
+		}
+		err = binary.verify(name, hash)
+		if err == nil {
+			err = m.place(path, binary)
+		}
+		binary.Close()
+		if err != nil {
+			return err
+		}
+	}
+	// Written after the binaries, so a mirror never lists a binary it lacks
+	err = m.write(sumsPath, sums)
+	if err != nil {
+		return err
+	}
+	for _, asset := range releaseExtras {
+		err = m.optional(releaseAssetPath(tag, asset))
+		if err != nil {
+			return err
+		}
+	}
+	return m.source(tag)
+}
+
+// source mirrors the release's zipball and unpacks it under raw/<tag>/, which is
+// where stations fetch single changed files from when updating their source.
+func (m *mirror) source(tag string) error {
+	resolution := Resolution{Ref: tag}
+	path := resolution.zipballPath()
+	zipball, err := m.client.download(m.client.url(path), "")
+	if err != nil {
+		return err
+	}
+	defer zipball.Close()
+	unchanged := m.unchanged
+	err = m.place(path, zipball)
+	if err != nil {
+		return err
+	}
+	raw := m.local(resolution.rawPath(""))
+	if _, err := os.Stat(raw); err == nil && m.unchanged > unchanged {
+		return nil
+	}
+	return extractZip(zipball, zipball.Size, raw, 1)
+}
+
+// file mirrors path, streaming it to disk rather than holding it in memory.
+func (m *mirror) file(path string) error {
+	downloaded, err := m.client.download(m.client.url(path), "")
+	if err != nil {
+		return err
+	}
+	defer downloaded.Close()
+	return m.place(path, downloaded)
+}
+
+// optional mirrors path if upstream has it; older releases lack some assets.
+func (m *mirror) optional(path string) error {
+	err := m.file(path)
+	if errors.Is(err, errNotFound) {
+		log.Warn().Str("path", path).Msg("Not published upstream; skipping")
+		return nil
+	}
+	return err
+}
+
+func (m *mirror) write(path string, data []byte) error {
+	if existing, err := os.ReadFile(m.local(path)); err == nil && bytes.Equal(existing, data) {
+		m.unchanged++
+		return nil
+	}
+	m.downloaded++
+	log.Debug().Str("path", path).Int("bytes", len(data)).Msg("Mirrored")
+	return writeFileAtomic(m.local(path), data, 0644)
+}
+
+// place copies a download into the mirror unless the mirror already has the same
+// file. The copy is written beside the target and renamed over it, since stations
+// may be reading the old one.
+func (m *mirror) place(path string, downloaded *downloadedFile) error {
+	target := m.local(path)
+	if existing, err := HashFile(target); err == nil && existing == downloaded.SHA256 {
+		m.unchanged++
+		return nil
+	}
+	m.downloaded++
+	log.Debug().Str("path", path).Int64("bytes", downloaded.Size).Msg("Mirrored")
+	if planEffect(EffectWrite, target, fmt.Sprintf("%d bytes, mode 0644", downloaded.Size)) {
+		return nil
+	}
+	err := os.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(target), "."+filepath.Base(target)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, io.NewSectionReader(downloaded, 0, downloaded.Size))
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", target, err)
+	}
+	return os.Rename(tmp.Name(), target)
+}
+
+func (m *mirror) local(path string) string {
+	return filepath.Join(m.dir, filepath.FromSlash(path))
+}
@@ -1,10 +1,15 @@
 package utils
 
 import (
-	"embed"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
 	"strings"
 
@@ -12,67 +17,72 @@ import (
 )
 
 func RunShellCommand(command string) error {
+	if planEffect(shellEffectKind(command), command, "") {
+		return nil
+	}
 	cmd := exec.Command("sh", "-c", command)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	return cmd.Run()
 }
 
+// ShellOutput runs command and returns its trimmed stdout.
+func ShellOutput(command string) (string, error) {
+	out, err := exec.Command("sh", "-c", command).Output()
+	return strings.TrimSpace(string(out)), err
+}
+
+// envUserConfirmed carries a confirmed user mismatch to a re-run of the binary.
+const envUserConfirmed = "ICESLAB_USER_CONFIRMED"
+
+// CheckIfCorrectUser asks for confirmation when iceslab is not run by the admin user.
+// Without a terminal to ask on, it fails like RequireUser instead of reading EOF.
 func CheckIfCorrectUser() error {
 	expectedUser := "admin"
-	currentUser := os.Getenv("USER")
-	if currentUser != expectedUser {
-		log.Warn().Msgf("Current user '%s' does not match expected user '%s'. Continue? (y/n)", currentUser, expectedUser)
-		var response string
-		_, err := fmt.Scanln(&response)
-		if err != nil {
-			return fmt.Errorf("failed to read user response: %w", err)
-		}
+	currentUser := InvokingUser()
+	if currentUser == expectedUser || os.Getenv(envUserConfirmed) == currentUser {
+		return nil
+	}
+	if !stdinIsTerminal() {
+		return RequireUser(expectedUser)
+	}
+	log.Warn().Msgf("Current user '%s' does not match expected user '%s'. Continue? (y/n)", currentUser, expectedUser)
+	var response string
+	_, err := fmt.Scanln(&response)
+	if err != nil {
+		return fmt.Errorf("failed to read user response: %w", err)
+	}
 
-		if response != "y" && response != "Y" {
-			return fmt.Errorf("user did not confirm continuation; exiting")
-		} else {
-			log.Info().Msg("User confirmed continuation despite mismatch")
-		}
+	if response != "y" && response != "Y" {
+		return fmt.Errorf("user did not confirm continuation; exiting")
+	} else {
+		log.Info().Msg("User confirmed continuation despite mismatch")
+		// A re-run of the binary, e.g. from the install path, does not ask again
+		os.Setenv(envUserConfirmed, currentUser)
 	}
 	return nil
 }
 
-func GetStationID() (string, error) {
-	bytes, err := os.ReadFile(".station_id")
-	switch err.(type) {
-	case nil:
-		ID := string(bytes)
-		log.Debug().Str("station_id", ID).Msg("Loaded station ID from file")
-		return ID, nil
-	case *os.PathError:
-		log.Info().Msg("No station ID file found; prompting user for station ID")
-		ID, err := PromptForStationID()
-		if err != nil {
-			return "", fmt.Errorf("failed to prompt for station ID: %w", err)
-		}
-		err = os.WriteFile(".station_id", []byte(ID), 0644)
-		if err != nil {
-			return "", fmt.Errorf("failed to save station ID: %w", err)
-		}
-		log.Info().Str("station_id", ID).Msg("Station ID saved successfully")
-		return ID, nil
-	default:
-		return "", fmt.Errorf("failed to read station ID file: %w", err)
+// RequireUser is the non-interactive form of CheckIfCorrectUser.
+func RequireUser(expectedUser string) error {
+	currentUser := InvokingUser()
+	if currentUser != expectedUser {
+		return fmt.Errorf("current user '%s' does not match expected user '%s'", currentUser, expectedUser)
 	}
+	return nil
 }
 
-func PromptForStationID() (string, error) {
-	var stationNum string
-	log.Info().Msg("Please enter the station number (e.g., 01, 02, etc.):")
-	_, err := fmt.Scanln(&stationNum)
-	if err != nil {
-		return "", err
-	}
-	if len(stationNum) == 1 && stationNum >= "1" && stationNum <= "9" {
-		stationNum = "0" + stationNum
+// Interactive reports whether stdin is a terminal someone can answer prompts on.
+func Interactive() bool {
+	return stdinIsTerminal()
+}
+
+// InvokingUser returns the user who ran iceslab, looking through sudo.
+func InvokingUser() string {
+	if sudoUser := os.Getenv("SUDO_USER"); sudoUser != "" {
+		return sudoUser
 	}
-	return stationNum, nil
+	return os.Getenv("USER")
 }
 
 func MoveFile(src, dest string) error {
@@ -88,6 +98,23 @@ func MoveFile(src, dest string) error {
 		return fmt.Errorf("source file %s does not exist: %w", src, err)
 	}
 
+	if planEffect(EffectMove, src, "-> "+dest) {
+		return nil
+	}
+
+	if recording != nil {
+		if info, err := os.Stat(src); err == nil && info.Mode().IsRegular() {
+			data, err := os.ReadFile(src)
+			if err != nil {
+				return fmt.Errorf("failed to read %s: %w", src, err)
+			}
+			err = recordWrite(dest, data)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
 	destDir := filepath.Dir(dest)
 	err := os.MkdirAll(destDir, 0755)
 	if err != nil {
@@ -103,59 +130,157 @@ func MoveFile(src, dest string) error {
 	return nil
 }
 
-func DumpAssets(efs embed.FS, src, dest string) error {
-	entries, err := efs.ReadDir(src)
+func DumpAssets(assets fs.FS, src, dest string) error {
+	entries, err := fs.ReadDir(assets, src)
 	if err != nil {
 		return err
 	}
 	for _, entry := range entries {
-		fullSrc := filepath.Join(src, entry.Name())
+		fullSrc := path.Join(src, entry.Name())
 		fullDest := filepath.Join(dest, entry.Name())
 		if entry.IsDir() {
-			err = os.MkdirAll(fullDest, 0755)
+			err = mkdirAll(fullDest, 0755)
 			if err != nil {
 				return err
 			}
-			err = DumpAssets(efs, fullSrc, fullDest)
+			err = DumpAssets(assets, fullSrc, fullDest)
 			if err != nil {
 				return err
 			}
-		} else {
-			alreadyExists := false
-			if _, err := os.Stat(fullDest); err == nil {
-				alreadyExists = true
-				log.Debug().Str("file", entry.Name()).Str("path", fullDest).Msg("Asset already exists, skipping")
-				continue
-			}
-			if !alreadyExists {
-				data, err := efs.ReadFile(fullSrc)
-				if err != nil {
-					log.Warn().Err(err).Str("file", entry.Name()).Str("path", fullDest).Msg("Failed to read asset")
-					continue
-				}
-				err = writeFile(fullDest, data, 0644)
+			continue
+		}
+		mode := AssetMode(entry.Name())
+		if info, err := os.Stat(fullDest); err == nil {
+			log.Debug().Str("file", entry.Name()).Str("path", fullDest).Msg("Asset already exists, skipping")
+			// Earlier versions wrote scripts as 0644 and made them executable on use
+			if info.Mode().Perm() != mode {
+				err = chmod(fullDest, mode)
 				if err != nil {
-					log.Warn().Err(err).Str("file", entry.Name()).Str("path", fullDest).Msg("Failed to write asset")
-					continue
-				} else {
-					log.Info().Str("file", entry.Name()).Str("path", fullDest).Msg("Asset written")
-					continue
+					log.Warn().Err(err).Str("file", entry.Name()).Str("path", fullDest).Msg("Failed to fix asset mode")
 				}
 			}
+			continue
+		}
+		data, err := fs.ReadFile(assets, fullSrc)
+		if err != nil {
+			log.Warn().Err(err).Str("file", entry.Name()).Str("path", fullDest).Msg("Failed to read asset")
+			continue
+		}
+		err = writeFile(fullDest, data, mode)
+		if err != nil {
+			log.Warn().Err(err).Str("file", entry.Name()).Str("path", fullDest).Msg("Failed to write asset")
+			continue
 		}
+		log.Info().Str("file", entry.Name()).Str("path", fullDest).Msg("Asset written")
 	}
 
 	return nil
 }
 
 func writeFile(path string, data []byte, perm os.FileMode) error {
+	if planEffect(EffectWrite, path, fmt.Sprintf("%d bytes, mode %04o", len(data), perm)) {
+		return nil
+	}
+	log.Debug().Str("path", path).Msg("Writing file")
+	err := recordWrite(path, data)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(path)
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(path, data, perm)
+	if err != nil {
+		return err
+	}
+	refreshRecordedWrite(path, data)
+	return nil
+}
+
+// writeFileFrom is writeFile for files too large to hold in memory, such as the
+// binary, streaming r to path. It returns the SHA-256 of what it wrote. Nothing is
+// recorded: install records the binary it copies, and updates refresh that hash.
+func writeFileFrom(path string, r io.Reader, perm os.FileMode) (string, error) {
+	sum := sha256.New()
+	if planEffect(EffectWrite, path, fmt.Sprintf("mode %04o", perm)) {
+		_, err := io.Copy(sum, r)
+		return hex.EncodeToString(sum.Sum(nil)), err
+	}
 	log.Debug().Str("path", path).Msg("Writing file")
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return "", err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(io.MultiWriter(file, sum), r)
+	if err == nil {
+		// O_TRUNC keeps the mode of a file left from an earlier run
+		err = file.Chmod(perm)
+	}
+	if err != nil {
+		file.Close()
+		return "", err
+	}
+	return hex.EncodeToString(sum.Sum(nil)), file.Close()
+}
+
+// refreshRecordedWrite keeps the install record's hash of path current when iceslab
+// rewrites an installed file after install, e.g. the policies when bookmarks change.
+// During install recordWrite has already done so.
+func refreshRecordedWrite(path string, data []byte) {
+	if recording != nil {
+		return
+	}
+	sum := sha256.Sum256(data)
+	err := refreshRecordedHash(path, hex.EncodeToString(sum[:]))
+	if err != nil {
+		log.Warn().Err(err).Str("path", path).Msg("Failed to update install record")
+	}
+}
+
+// writeFileAtomic is writeFile for files read while they are replaced: the data is
+// written beside path and renamed over it, so readers see the old or the new file.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	if planEffect(EffectWrite, path, fmt.Sprintf("%d bytes, mode %04o", len(data), perm)) {
+		return nil
+	}
+	log.Debug().Str("path", path).Msg("Writing file")
+	err := recordWrite(path, data)
+	if err != nil {
+		return err
+	}
 	dir := filepath.Dir(path)
-	err := os.MkdirAll(dir, 0755)
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	err = os.Rename(tmp.Name(), path)
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(path, data, perm)
+	refreshRecordedWrite(path, data)
+	return nil
 }
 
 func getAssetPath() string {
@@ -172,11 +297,14 @@ func getAssetPath() string {
 func RunScript(path string) error {
 	if _, err := os.Stat(path); err == nil {
 		log.Info().Str("script", path).Msg("Running script")
-		err = os.Chmod(path, 0755)
+		err = chmod(path, 0755)
 		if err != nil {
 			return fmt.Errorf("failed to make script executable: %w", err)
 		}
 		cmd := fmt.Sprintf("./%s", path)
+		if planEffect(EffectExec, cmd, "") {
+			return nil
+		}
 		if err := exec.Command(cmd).Run(); err != nil {
 			return fmt.Errorf("failed to run script: %w", err)
 		}
@@ -185,18 +313,39 @@ func RunScript(path string) error {
 	return nil
 }
 
+// RerunError is a re-run of the binary that exited non-zero; the caller exits with
+// the same Code, so automation sees the failure.
+type RerunError struct {
+	Path string
+	Code int
+}
+
+func (e *RerunError) Error() string {
+	return fmt.Sprintf("%s exited with status %d", e.Path, e.Code)
+}
+
+// RerunBinary runs the binary at path with args on this terminal and waits for it.
 func RerunBinary(path string, args ...string) error {
-	if _, err := os.Stat(path); err == nil {
-		log.Info().Str("binary", path).Msg("Running binary")
-		cmd := exec.Command(path, args...)
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		err := cmd.Start()
-		if err != nil {
-			return fmt.Errorf("failed to run binary: %w", err)
-		}
-		log.Info().Str("binary", path).Msg("Binary completed successfully")
+	if _, err := os.Stat(path); err != nil {
+		return fmt.Errorf("failed to run binary: %w", err)
+	}
+	if planEffect(EffectExec, path, strings.Join(args, " ")) {
+		return nil
 	}
+	log.Info().Str("binary", path).Msg("Running binary")
+	cmd := exec.Command(path, args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return &RerunError{Path: path, Code: exitErr.ExitCode()}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to run binary: %w", err)
+	}
+	log.Info().Str("binary", path).Msg("Binary completed successfully")
 	return nil
 }
 
@@ -208,6 +357,11 @@ func CopyDirectoryTo(src, dest string) error {
 		return fmt.Errorf("destination %s is a subpath of source %s", dest, src)
 	}
 
+	// The source may itself only exist in the plan, so record the copy as a whole
+	if planEffect(EffectCopy, src, "-> "+dest) {
+		return nil
+	}
+
 	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
@@ -218,7 +372,7 @@ func CopyDirectoryTo(src, dest string) error {
 		}
 		destPath := filepath.Join(dest, relPath)
 		if info.IsDir() {
-			return os.MkdirAll(destPath, 0755)
+			return mkdirAll(destPath, 0755)
 		}
 		data, err := os.ReadFile(path)
 		if err != nil {
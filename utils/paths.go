@@ -0,0 +1,182 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/rs/zerolog/log"
+	"go.yaml.in/yaml/v4"
+)
+
+const (
+	EnvRoot     = "ICESLAB_ROOT"
+	defaultRoot = "/"
+)
+
+// Paths resolves every file iceslab reads or writes from a single root, following
+// the FHS: the binary and shipped assets under /opt, state under /var/lib and
+// config under /etc. A root other than "/" relocates the whole tree, e.g. for testing.
+type Paths struct {
+	Root string
+
+	InstallDir     string
+	Binary         string
+	PreviousBinary string
+	Assets         string
+	Manifest       string
+	GuestTemplate  string
+
+	Bookmarks        string
+	Inventory        string
+	BrowserNetwork   string
+	PoliciesSource   string
+	FirefoxPolicies  string
+	ChromiumPolicies string
+
+	ConfigDir    string
+	Config       string
+	LegacyConfig string
+	GitHubToken  string
+	ServeToken   string
+	ReportSecret string
+
+	StateDir      string
+	BookmarksETag string
+	InventoryETag string
+	Source        string
+	Downloads     string
+
+	SourceVersion    string
+	BookmarksVersion string
+
+	ReleasesCache string
+	RateLimit     string
+	RolloutState  string
+	RolloutReport string
+
+	ServeDir     string
+	ServeReports string
+
+	LogDir  string
+	LogFile string
+
+	UpdateLock    string
+	UpdateService string
+	UpdateTimer   string
+
+	Etc      string
+	Hostname string
+	Sudoers  string
+}
+
+func NewPaths(root string) Paths {
+	if root == "" {
+		root = defaultRoot
+	}
+	root = filepath.Clean(root)
+	join := func(elem ...string) string {
+		return filepath.Join(append([]string{root}, elem...)...)
+	}
+
+	p := Paths{Root: root}
+	p.InstallDir = join("opt", "iceslab")
+	p.Binary = filepath.Join(p.InstallDir, "iceslab")
+	p.PreviousBinary = p.Binary + ".prev"
+	p.Assets = filepath.Join(p.InstallDir, "assets")
+	p.Manifest = filepath.Join(p.InstallDir, "manifest.yaml")
+	p.GuestTemplate = filepath.Join(p.InstallDir, "guest-template")
+
+	p.Bookmarks = filepath.Join(p.Assets, "bookmarks")
+	p.Inventory = filepath.Join(p.Assets, "inventory.yaml")
+	p.BrowserNetwork = filepath.Join(p.Assets, "browser.yaml")
+	p.PoliciesSource = filepath.Join(p.Assets, "etc")
+	p.FirefoxPolicies = filepath.Join(p.PoliciesSource, "firefox", "policies", "policies.json")
+	p.ChromiumPolicies = filepath.Join(p.PoliciesSource, "chromium", "policies", "managed", "policies.json")
+
+	p.ConfigDir = join("etc", "iceslab")
+	p.Config = filepath.Join(p.ConfigDir, "config.yaml")
+	p.LegacyConfig = filepath.Join(p.ConfigDir, "iceslab.conf")
+	p.GitHubToken = filepath.Join(p.ConfigDir, "github-token")
+	p.ServeToken = filepath.Join(p.ConfigDir, "serve-token")
+	p.ReportSecret = filepath.Join(p.ConfigDir, "report-secret")
+
+	p.StateDir = join("var", "lib", "iceslab")
+	p.BookmarksETag = filepath.Join(p.StateDir, "etag_bookmarks")
+	p.InventoryETag = filepath.Join(p.StateDir, "etag_inventory")
+	p.Source = filepath.Join(p.StateDir, "source")
+	p.Downloads = filepath.Join(p.StateDir, "downloads")
+	p.SourceVersion = filepath.Join(p.StateDir, "source_version")
+	p.BookmarksVersion = filepath.Join(p.StateDir, "bookmarks_version")
+	p.ReleasesCache = filepath.Join(p.StateDir, "releases.json")
+	p.RateLimit = filepath.Join(p.StateDir, "github_ratelimit.json")
+	p.RolloutState = filepath.Join(p.StateDir, "rollout.json")
+	p.RolloutReport = filepath.Join(p.StateDir, "rollout_report.json")
+	p.ServeDir = filepath.Join(p.StateDir, "mirror")
+	p.ServeReports = filepath.Join(p.StateDir, "reports")
+
+	p.LogDir = join("var", "log", "iceslab")
+	p.LogFile = filepath.Join(p.LogDir, "iceslab.log")
+
+	p.UpdateLock = join("run", "iceslab", "update.lock")
+	p.UpdateService = join("etc", "systemd", "system", UpdateUnit+".service")
+	p.UpdateTimer = join("etc", "systemd", "system", UpdateUnit+".timer")
+
+	p.Etc = join("etc")
+	p.Hostname = join("etc", "hostname")
+	p.Sudoers = join("etc", "sudoers.d", "iceslab")
+	return p
+}
+
+// InstalledPath maps a file under the shipped assets/etc tree to where it is installed.
+func (p Paths) InstalledPath(policySource string) string {
+	rel, err := filepath.Rel(p.PoliciesSource, policySource)
+	if err != nil {
+		return policySource
+	}
+	return filepath.Join(p.Etc, rel)
+}
+
+var paths = NewPaths(defaultRoot)
+
+// rootFromFlag is set when -root chose the root; every other source is one a child
+// process resolves by itself.
+var rootFromFlag bool
+
+func CurrentPaths() Paths {
+	return paths
+}
+
+// SetRoot resolves all paths from root. An empty root falls back to $ICESLAB_ROOT,
+// then to the root setting in /etc/iceslab/config.yaml, then to "/".
+func SetRoot(root string) Paths {
+	source := "flag"
+	if root == "" {
+		root, source = os.Getenv(EnvRoot), "env"
+	}
+	if root == "" {
+		root, source = configuredRoot(), "config"
+	}
+	if root == "" {
+		root, source = defaultRoot, "default"
+	}
+	paths = NewPaths(root)
+	rootFromFlag = source == "flag"
+	log.Debug().Str("root", paths.Root).Str("source", source).Msg("Resolved install root")
+	return paths
+}
+
+// configuredRoot reads only the root key from the default config location, before
+// the rest of the config is loaded from under that root.
+func configuredRoot() string {
+	data, err := os.ReadFile(NewPaths(defaultRoot).Config)
+	if err != nil {
+		return ""
+	}
+	var cfg struct {
+		Root string `yaml:"root"`
+	}
+	if yaml.Unmarshal(data, &cfg) != nil {
+		return ""
+	}
+	return cfg.Root
+}
@@ -0,0 +1,343 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	RecordFile = "file"
+	RecordDir  = "dir"
+	RecordTree = "tree"
+	RecordUser = "user"
+	RecordUnit = "unit"
+
+	installRecordVersion = 1
+)
+
+// InstallRecord lists everything install created or modified, in order, so that
+// uninstall can revert exactly that and nothing else.
+type InstallRecord struct {
+	Version int           `json:"version"`
+	Entries []RecordEntry `json:"entries"`
+}
+
+type RecordEntry struct {
+	Kind string `json:"kind"`
+	// Path is set for files, directories and trees; Name for users and units.
+	Path string `json:"path,omitempty"`
+	Name string `json:"name,omitempty"`
+	// Hash is the SHA-256 of the last content iceslab wrote to a file.
+	Hash string `json:"hash,omitempty"`
+	// Backup holds the original of a file that existed before install modified it.
+	Backup string      `json:"backup,omitempty"`
+	Mode   os.FileMode `json:"mode,omitempty"`
+}
+
+func recordPath() string {
+	return filepath.Join(paths.StateDir, "install-record.json")
+}
+
+func backupDir() string {
+	return filepath.Join(paths.StateDir, "backup")
+}
+
+// recording is the active record while install runs; nil otherwise.
+var recording *InstallRecord
+
+func LoadInstallRecord() (*InstallRecord, error) {
+	data, err := os.ReadFile(recordPath())
+	if err != nil {
+		return nil, err
+	}
+	var record InstallRecord
+	err = json.Unmarshal(data, &record)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse install record: %w", err)
+	}
+	if record.Version != installRecordVersion {
+		return nil, fmt.Errorf("unsupported install record version %d", record.Version)
+	}
+	return &record, nil
+}
+
+// StartInstallRecord begins recording changes, continuing the record of a previous
+// install if there is one. Dry runs change nothing and so record nothing.
+func StartInstallRecord() error {
+	if dryRun {
+		return nil
+	}
+	record, err := LoadInstallRecord()
+	switch {
+	case err == nil:
+		recording = record
+	case os.IsNotExist(err):
+		recording = &InstallRecord{Version: installRecordVersion}
+	default:
+		return err
+	}
+	// The state directory holds the record itself, so record it first
+	recordCreatedDirs(paths.StateDir)
+	return saveInstallRecord()
+}
+
+func saveInstallRecord() error {
+	data, err := json.MarshalIndent(recording, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(paths.StateDir, 0755)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(recordPath(), data, 0600)
+}
+
+// RefreshRecordedHash updates the hash of a file the install created after iceslab
+// itself replaced it, e.g. by a self-update, so uninstall still treats it as unmodified.
+func RefreshRecordedHash(path string) error {
+	hash, err := HashFile(path)
+	if err != nil {
+		return err
+	}
+	return refreshRecordedHash(path, hash)
+}
+
+func refreshRecordedHash(path, hash string) error {
+	return updateInstallRecord(func(record *InstallRecord) bool {
+		entry := record.find(RecordFile, filepath.Clean(path))
+		if entry == nil || entry.Hash == "" || entry.Hash == hash {
+			return false
+		}
+		entry.Hash = hash
+		return true
+	})
+}
+
+// recordOwnedTree records dir as a tree iceslab replaces as a whole after install,
+// such as the bookmarks, so uninstall removes it whatever files it now holds.
+func recordOwnedTree(dir string) error {
+	return updateInstallRecord(func(record *InstallRecord) bool {
+		dir = filepath.Clean(dir)
+		if record.find(RecordTree, dir) != nil {
+			return false
+		}
+		record.Entries = append(record.Entries, RecordEntry{Kind: RecordTree, Path: dir})
+		return true
+	})
+}
+
+// deferredRecord is the saved record as commands other than install change it, e.g.
+// each time they rewrite an installed file. It is loaded on first use and written
+// once, by FlushInstallRecord, when the command is done.
+var deferredRecord struct {
+	record  *InstallRecord
+	loaded  bool
+	changed bool
+}
+
+// updateInstallRecord applies fn to the active record, or outside install to the
+// saved one if there is one. During install a change is saved at once; otherwise
+// FlushInstallRecord saves it.
+func updateInstallRecord(fn func(record *InstallRecord) bool) error {
+	if dryRun {
+		return nil
+	}
+	if recording != nil {
+		if !fn(recording) {
+			return nil
+		}
+		return saveInstallRecord()
+	}
+	if !deferredRecord.loaded {
+		record, err := LoadInstallRecord()
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		deferredRecord.record, deferredRecord.loaded = record, true
+	}
+	if deferredRecord.record != nil && fn(deferredRecord.record) {
+		deferredRecord.changed = true
+	}
+	return nil
+}
+
+// FlushInstallRecord saves the changes commands other than install made to the
+// install record. main runs it after every command.
+func FlushInstallRecord() error {
+	if !deferredRecord.changed {
+		return nil
+	}
+	data, err := json.MarshalIndent(deferredRecord.record, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(recordPath(), data, 0600)
+	if err != nil {
+		return err
+	}
+	deferredRecord.changed = false
+	return nil
+}
+
+func (r *InstallRecord) find(kind, key string) *RecordEntry {
+	for i := range r.Entries {
+		e := &r.Entries[i]
+		if e.Kind == kind && (e.Path == key || e.Name == key) {
+			return e
+		}
+	}
+	return nil
+}
+
+func (r *InstallRecord) add(entry RecordEntry) {
+	r.Entries = append(r.Entries, entry)
+	err := saveInstallRecord()
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to save install record")
+	}
+}
+
+// recordCreatedDirs records the ancestors of dir that do not exist yet, outermost first.
+func recordCreatedDirs(dir string) {
+	if recording == nil {
+		return
+	}
+	var missing []string
+	for d := filepath.Clean(dir); ; d = filepath.Dir(d) {
+		if _, err := os.Stat(d); err == nil {
+			break
+		}
+		missing = append(missing, d)
+		if d == filepath.Dir(d) {
+			break
+		}
+	}
+	for i := len(missing) - 1; i >= 0; i-- {
+		if recording.find(RecordDir, missing[i]) == nil {
+			recording.add(RecordEntry{Kind: RecordDir, Path: missing[i]})
+		}
+	}
+}
+
+// recordWrite is called before path is overwritten with data. The first time a
+// pre-existing file is touched its original is backed up.
+func recordWrite(path string, data []byte) error {
+	if recording == nil {
+		return nil
+	}
+	path = filepath.Clean(path)
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+
+	if entry := recording.find(RecordFile, path); entry != nil {
+		entry.Hash = hash
+		return saveInstallRecord()
+	}
+
+	entry := RecordEntry{Kind: RecordFile, Path: path, Hash: hash}
+	info, err := os.Stat(path)
+	switch {
+	case err == nil:
+		original, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read %s for backup: %w", path, err)
+		}
+		entry.Backup = filepath.Join(backupDir(), path)
+		entry.Mode = info.Mode().Perm()
+		err = os.MkdirAll(filepath.Dir(entry.Backup), 0700)
+		if err != nil {
+			return fmt.Errorf("failed to create backup directory: %w", err)
+		}
+		err = os.WriteFile(entry.Backup, original, 0600)
+		if err != nil {
+			return fmt.Errorf("failed to back up %s: %w", path, err)
+		}
+		log.Debug().Str("path", path).Str("backup", entry.Backup).Msg("Backed up original file")
+	case os.IsNotExist(err):
+		recordCreatedDirs(filepath.Dir(path))
+	default:
+		return err
+	}
+	recording.add(entry)
+	return nil
+}
+
+// recordCreatedFile records a file that now exists, e.g. after a move.
+func recordCreatedFile(path string) {
+	if recording == nil {
+		return
+	}
+	hash, err := HashFile(path)
+	if err != nil {
+		log.Warn().Err(err).Str("path", path).Msg("Failed to hash recorded file")
+	}
+	if entry := recording.find(RecordFile, path); entry != nil {
+		entry.Hash = hash
+		_ = saveInstallRecord()
+		return
+	}
+	recording.add(RecordEntry{Kind: RecordFile, Path: path, Hash: hash})
+}
+
+// ExternalSnapshot captures what existed before a script ran so that only what the
+// script created gets recorded afterwards.
+type ExternalSnapshot struct {
+	users map[string]bool
+	paths map[string]bool
+}
+
+func SnapshotExternal(users []string, pathList []string) ExternalSnapshot {
+	snap := ExternalSnapshot{users: map[string]bool{}, paths: map[string]bool{}}
+	for _, name := range users {
+		_, err := user.Lookup(name)
+		snap.users[name] = err == nil
+	}
+	for _, p := range pathList {
+		_, err := os.Stat(p)
+		snap.paths[p] = err == nil
+	}
+	return snap
+}
+
+// RecordUserIfCreated records name if it did not exist in the snapshot but does now.
+func (s ExternalSnapshot) RecordUserIfCreated(name string) {
+	if recording == nil || s.users[name] || recording.find(RecordUser, name) != nil {
+		return
+	}
+	if _, err := user.Lookup(name); err == nil {
+		recording.add(RecordEntry{Kind: RecordUser, Name: name})
+	}
+}
+
+// RecordPathIfCreated records path as a file, or as a whole tree for directories.
+func (s ExternalSnapshot) RecordPathIfCreated(path string) {
+	if recording == nil || s.paths[path] {
+		return
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+	if info.IsDir() {
+		if recording.find(RecordTree, path) == nil {
+			recording.add(RecordEntry{Kind: RecordTree, Path: path})
+		}
+		return
+	}
+	recordCreatedFile(path)
+}
+
+func RecordEnabledUnit(name string) {
+	if recording == nil || recording.find(RecordUnit, name) != nil {
+		return
+	}
+	recording.add(RecordEntry{Kind: RecordUnit, Name: name})
+}
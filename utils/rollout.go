@@ -0,0 +1,314 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const defaultRolloutSoak = 24 * time.Hour
+
+// RolloutConfig stages updates from the stable and beta channels. Canary stations,
+// those in CanaryGroup or in the first CanaryPercent buckets of the station ID, take a
+// new version as soon as it is published; every other station waits until it is
+// Soak old and no station has reported a failure with it. Pinned channels are never
+// held back.
+type RolloutConfig struct {
+	CanaryGroup   string `yaml:"canary_group,omitempty" json:"canary_group,omitempty"`
+	CanaryPercent int    `yaml:"canary_percent,omitempty" json:"canary_percent,omitempty"`
+	Soak          string `yaml:"soak,omitempty" json:"soak,omitempty"`
+	// ReportURL is where stations report how a new version went: a directory (or
+	// file:// URL) shared by the stations, or an http(s) endpoint such as 'iceslab serve'.
+	ReportURL string `yaml:"report_url,omitempty" json:"report_url,omitempty"`
+}
+
+func (r RolloutConfig) Enabled() bool {
+	return r.CanaryGroup != "" || r.CanaryPercent > 0
+}
+
+func (r RolloutConfig) soak() (time.Duration, error) {
+	return parseAgentDuration(r.Soak, defaultRolloutSoak)
+}
+
+// RolloutBucket places a station in 0-99 by a hash of its ID, so the same stations
+// are canaries every time and on every machine that computes it.
+func RolloutBucket(stationID string) int {
+	sum := sha256.Sum256([]byte(stationID))
+	return int(binary.BigEndian.Uint64(sum[:8]) % 100)
+}
+
+func (r RolloutConfig) IsCanary(stationID string) bool {
+	if r.CanaryPercent > 0 && RolloutBucket(stationID) < r.CanaryPercent {
+		return true
+	}
+	return r.CanaryGroup != "" && stationID != "" && LookupStation(stationID).Group == r.CanaryGroup
+}
+
+// RolloutCandidate is a version newer than what the station has installed.
+type RolloutCandidate struct {
+	Component string
+	Version   string
+	// Published is when the version appeared upstream; zero if unknown, in which
+	// case the soak time counts from when this station first saw it.
+	Published time.Time
+}
+
+// RolloutReport is what a station reports after installing a new version.
+type RolloutReport struct {
+	StationID string    `json:"station_id"`
+	Component string    `json:"component"`
+	Version   string    `json:"version"`
+	OK        bool      `json:"ok"`
+	Error     string    `json:"error,omitempty"`
+	At        time.Time `json:"at"`
+}
+
+// rolloutHold reports whether the station should stay on its current version for
+// now, and why. The rollout is loaded from the config; a config that cannot be read
+// holds nothing back.
+func (c *Client) rolloutHold(candidate RolloutCandidate, stationID string) (bool, string) {
+	cfg, err := LoadConfig()
+	if err != nil || !cfg.Rollout.Enabled() {
+		return false, ""
+	}
+	rollout := cfg.Rollout
+	if rollout.IsCanary(stationID) {
+		log.Info().Str("component", candidate.Component).Str("version", candidate.Version).Msg("Canary station; taking the new version first")
+		return false, ""
+	}
+
+	soak, err := rollout.soak()
+	if err != nil {
+		return true, "rollout.soak: " + err.Error()
+	}
+	since := candidate.Published
+	if seen := firstSeen(candidate); since.IsZero() || seen.Before(since) {
+		since = seen
+	}
+	if until := since.Add(soak); time.Now().Before(until) {
+		return true, "soaking on canaries until " + until.Format(time.DateTime)
+	}
+
+	reports, err := c.rolloutReports(rollout.ReportURL, candidate.Component, candidate.Version)
+	if err != nil {
+		// Fail closed: without the canaries' reports there is no telling whether they broke
+		return true, "cannot read canary reports: " + err.Error()
+	}
+	for _, report := range reports {
+		if !report.OK {
+			return true, fmt.Sprintf("station %s reported a failure: %s", report.StationID, report.Error)
+		}
+	}
+	return false, ""
+}
+
+// HoldRollout logs and reports whether a staged rollout keeps this station on its
+// current version of candidate.
+func (c *Client) HoldRollout(candidate RolloutCandidate, stationID string) bool {
+	hold, reason := c.rolloutHold(candidate, stationID)
+	if hold {
+		log.Info().Str("component", candidate.Component).Str("version", candidate.Version).Str("reason", reason).Msg("Update held back by staged rollout")
+	}
+	return hold
+}
+
+// BookmarksCandidate asks, without downloading it, whether the channel's bookmarks
+// differ from the installed ones. It returns nil when they do not, when no staged
+// rollout is configured, or when that cannot be told, in which case the update itself
+// reports the problem.
+func (c *Client) BookmarksCandidate(resolution Resolution) *RolloutCandidate {
+	cfg, err := LoadConfig()
+	if err != nil || !cfg.Rollout.Enabled() || resolution.isPinned() {
+		return nil
+	}
+	localETag, _ := os.ReadFile(paths.BookmarksETag)
+	response, err := c.headBookmarks(resolution, string(localETag))
+	if err != nil {
+		log.Debug().Err(err).Msg("Failed to check for new bookmarks")
+		return nil
+	}
+	etag := response.Header.Get("ETag")
+	if response.StatusCode != http.StatusOK || etag == "" || etag == string(localETag) {
+		return nil
+	}
+	candidate := &RolloutCandidate{Component: "bookmarks", Version: strings.Trim(etag, `"`)}
+	if modified, err := http.ParseTime(response.Header.Get("Last-Modified")); err == nil {
+		candidate.Published = modified
+	}
+	return candidate
+}
+
+// firstSeen returns, and remembers, when this station first saw the candidate.
+func firstSeen(candidate RolloutCandidate) time.Time {
+	seen := map[string]struct {
+		Version string    `json:"version"`
+		At      time.Time `json:"at"`
+	}{}
+	data, err := os.ReadFile(paths.RolloutState)
+	if err == nil {
+		_ = json.Unmarshal(data, &seen)
+	}
+	entry, ok := seen[candidate.Component]
+	if ok && entry.Version == candidate.Version {
+		return entry.At
+	}
+	entry.Version, entry.At = candidate.Version, time.Now()
+	seen[candidate.Component] = entry
+	data, err = json.MarshalIndent(seen, "", "  ")
+	if err == nil {
+		err = writeFile(paths.RolloutState, data, 0644)
+	}
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to save rollout state")
+	}
+	return entry.At
+}
+
+// ReportRollout records how installing the candidate went: always in the local status
+// file, and at the rollout's report URL if there is one. Failures to report are logged.
+func (c *Client) ReportRollout(candidate RolloutCandidate, stationID string, installErr error) {
+	report := RolloutReport{
+		StationID: stationID,
+		Component: candidate.Component,
+		Version:   candidate.Version,
+		OK:        installErr == nil,
+		At:        time.Now().UTC(),
+	}
+	if installErr != nil {
+		report.Error = installErr.Error()
+	}
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return
+	}
+	err = writeFile(paths.RolloutReport, data, 0644)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to write rollout report")
+	}
+
+	cfg, err := LoadConfig()
+	if err != nil || cfg.Rollout.ReportURL == "" || DryRun() {
+		return
+	}
+	err = c.sendRolloutReport(cfg.Rollout.ReportURL, report, data)
+	if err != nil {
+		log.Warn().Err(err).Str("report_url", cfg.Rollout.ReportURL).Msg("Failed to send rollout report")
+		return
+	}
+	log.Info().Str("component", report.Component).Str("version", report.Version).Bool("ok", report.OK).Msg("Rollout report sent")
+}
+
+var unsafeReportChars = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+// reportDir is where reports for one version live in a shared report directory:
+// <dir>/<component>/<version>/<station>.json.
+func reportDir(dir, component, version string) string {
+	return filepath.Join(dir, unsafeReportChars.ReplaceAllString(component, "_"), unsafeReportChars.ReplaceAllString(version, "_"))
+}
+
+// reportDirectory returns the local directory for a file:// or path report URL.
+func reportDirectory(reportURL string) (string, bool) {
+	reportURL = NormalizeUpdateURL(reportURL)
+	dir, ok := strings.CutPrefix(reportURL, "file://")
+	return dir, ok
+}
+
+// ReportSecret returns the secret stations send with their reports and 'iceslab serve'
+// expects, from the report secret file, or "" if there is none.
+func ReportSecret() (string, error) {
+	return readSecret(paths.ReportSecret)
+}
+
+// The shared report directory is not part of the install, so it bypasses the effect layer.
+func (c *Client) sendRolloutReport(reportURL string, report RolloutReport, data []byte) error {
+	if dir, ok := reportDirectory(reportURL); ok {
+		dir = reportDir(dir, report.Component, report.Version)
+		err := os.MkdirAll(dir, 0775)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(filepath.Join(dir, unsafeReportChars.ReplaceAllString(report.StationID, "_")+".json"), data, 0664)
+	}
+	request, err := http.NewRequest(http.MethodPost, reportURL+"/reports", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	secret, err := ReportSecret()
+	if err != nil {
+		return err
+	}
+	if secret != "" {
+		request.Header.Set("Authorization", "Bearer "+secret)
+	}
+	response, err := c.do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status code: %d", response.StatusCode)
+	}
+	return nil
+}
+
+// rolloutReports returns every report for the version. Without a report URL there
+// are none.
+func (c *Client) rolloutReports(reportURL, component, version string) ([]RolloutReport, error) {
+	if reportURL == "" {
+		return nil, nil
+	}
+	if dir, ok := reportDirectory(reportURL); ok {
+		return readReportDir(reportDir(dir, component, version))
+	}
+	query := url.Values{"component": {component}, "version": {version}}
+	data, _, err := c.fetchIfChanged(reportURL+"/reports?"+query.Encode(), "")
+	if err != nil {
+		return nil, err
+	}
+	var reports []RolloutReport
+	err = json.Unmarshal(data, &reports)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode rollout reports: %w", err)
+	}
+	return reports, nil
+}
+
+func readReportDir(dir string) ([]RolloutReport, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var reports []RolloutReport
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var report RolloutReport
+		err = json.Unmarshal(data, &report)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode %s: %w", entry.Name(), err)
+		}
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
@@ -0,0 +1,402 @@
+package utils
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	defaultServeAddr     = ":8080"
+	defaultServeInterval = 15 * time.Minute
+	maxReportSize        = 64 << 10
+)
+
+// ServeConfig is the lab controller run by 'iceslab serve'.
+type ServeConfig struct {
+	Addr string
+	// Dir is the mirror the stations download from; Reports holds their rollout reports.
+	Dir     string
+	Reports string
+	// Upstream is where the mirror is synced from, GitHub unless set. It is never the
+	// configured update_url, which on the controller may well point at itself.
+	Upstream string
+	Interval time.Duration
+	Refs     []string
+	// Pin makes the stable and beta channels resolve to this release only.
+	Pin string
+	// Hold starts with upstream syncs paused, so the lab keeps what is in Dir.
+	Hold bool
+	// Token must be sent as a bearer token to change anything through the API, and
+	// ReportSecret to post a rollout report. Without one, the routes it guards only
+	// accept requests from this machine.
+	Token        string
+	ReportSecret string
+}
+
+// ServeStatus is what GET /api/status reports.
+type ServeStatus struct {
+	Upstream  string     `json:"upstream"`
+	Dir       string     `json:"dir"`
+	Pin       string     `json:"pin,omitempty"`
+	Held      bool       `json:"held"`
+	Syncing   bool       `json:"syncing"`
+	LastSync  *time.Time `json:"last_sync,omitempty"`
+	LastError string     `json:"last_error,omitempty"`
+	NextSync  *time.Time `json:"next_sync,omitempty"`
+	Releases  []string   `json:"releases"`
+}
+
+// ServeToken returns the token that guards the serve API, from the serve token file,
+// or "" if there is none.
+func ServeToken() (string, error) {
+	return readSecret(paths.ServeToken)
+}
+
+type server struct {
+	cfg    ServeConfig
+	client *Client
+	files  http.Handler
+	sync   sync.Mutex
+	mu     sync.Mutex
+	status ServeStatus
+}
+
+// Serve runs the lab controller until ctx is cancelled: it keeps cfg.Dir synced from
+// upstream as 'mirror sync' would, serves it to the stations over HTTP in the layout
+// update_url expects, collects their rollout reports, and exposes a small API to
+// inspect and steer what the lab receives.
+func Serve(ctx context.Context, token string, cfg ServeConfig) error {
+	if cfg.Addr == "" {
+		cfg.Addr = defaultServeAddr
+	}
+	if cfg.Interval == 0 {
+		cfg.Interval = defaultServeInterval
+	}
+	if cfg.Pin != "" {
+		err := ValidateChannel(cfg.Pin)
+		if err != nil {
+			return err
+		}
+		if commitPattern.MatchString(cfg.Pin) || cfg.Pin == ChannelStable || cfg.Pin == ChannelBeta {
+			return fmt.Errorf("pin must be a release tag, got %q", cfg.Pin)
+		}
+		if !slices.Contains(cfg.Refs, cfg.Pin) {
+			cfg.Refs = append(cfg.Refs, cfg.Pin)
+		}
+	}
+	client := NewClient(ctx, token)
+	client.baseURL = defaultUpdateURL
+	if cfg.Upstream != "" {
+		client.baseURL = NormalizeUpdateURL(cfg.Upstream)
+	}
+
+	// The mirror and reports are the controller's own data, not part of an install
+	for _, dir := range []string{cfg.Dir, cfg.Reports} {
+		err := os.MkdirAll(dir, 0755)
+		if err != nil {
+			return fmt.Errorf("failed to create %s: %w", dir, err)
+		}
+	}
+
+	s := &server{
+		cfg:    cfg,
+		client: client,
+		files:  http.FileServer(http.Dir(cfg.Dir)),
+		status: ServeStatus{Upstream: client.baseURL, Dir: cfg.Dir, Pin: cfg.Pin, Held: cfg.Hold},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/status", s.handleStatus)
+	mux.HandleFunc("POST /api/sync", requireSecret(cfg.Token, s.handleSync))
+	mux.HandleFunc("POST /api/hold", requireSecret(cfg.Token, s.handleHold(true)))
+	mux.HandleFunc("DELETE /api/hold", requireSecret(cfg.Token, s.handleHold(false)))
+	mux.HandleFunc("POST /reports", requireSecret(cfg.ReportSecret, s.handlePostReport))
+	mux.HandleFunc("GET /reports", s.handleGetReports)
+	mux.HandleFunc("GET /", s.handleFiles)
+
+	httpServer := &http.Server{
+		Addr:              cfg.Addr,
+		Handler:           logRequests(mux),
+		ReadHeaderTimeout: 10 * time.Second,
+		BaseContext:       func(net.Listener) context.Context { return ctx },
+	}
+	listener, err := net.Listen("tcp", cfg.Addr)
+	if err != nil {
+		return err
+	}
+	log.Info().Str("addr", listener.Addr().String()).Str("dir", cfg.Dir).Str("upstream", client.baseURL).
+		Dur("interval", cfg.Interval).Bool("held", cfg.Hold).Msg("Serving the lab")
+	if cfg.Token == "" {
+		log.Warn().Str("token_file", paths.ServeToken).Msg("No serve token; the API only accepts changes from this machine")
+	}
+	if cfg.ReportSecret == "" {
+		log.Warn().Str("secret_file", paths.ReportSecret).Msg("No report secret; rollout reports are only accepted from this machine")
+	}
+
+	go s.syncLoop(ctx)
+	go func() {
+		<-ctx.Done()
+		shutdown, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = httpServer.Shutdown(shutdown)
+	}()
+	err = httpServer.Serve(listener)
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// syncLoop syncs from upstream at startup and then every interval, unless held.
+func (s *server) syncLoop(ctx context.Context) {
+	for {
+		s.mu.Lock()
+		held := s.status.Held
+		s.mu.Unlock()
+		if !held {
+			s.syncNow()
+		}
+		next := time.Now().Add(s.cfg.Interval)
+		s.mu.Lock()
+		s.status.NextSync = &next
+		s.mu.Unlock()
+		select {
+		case <-time.After(s.cfg.Interval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// syncNow brings the mirror up to date with upstream. It reports false if a sync is
+// already running.
+func (s *server) syncNow() bool {
+	if !s.sync.TryLock() {
+		return false
+	}
+	defer s.sync.Unlock()
+	s.setSyncing(true)
+	err := s.client.MirrorSync(s.cfg.Dir, s.cfg.Refs, s.cfg.Pin)
+	now := time.Now()
+	s.mu.Lock()
+	s.status.Syncing = false
+	s.status.LastSync = &now
+	s.status.LastError = ""
+	if err != nil {
+		s.status.LastError = err.Error()
+	}
+	s.mu.Unlock()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to sync from upstream; stations keep the current mirror")
+	}
+	return true
+}
+
+func (s *server) setSyncing(syncing bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status.Syncing = syncing
+}
+
+func (s *server) mirroredReleases() []string {
+	releases := []string{}
+	data, err := os.ReadFile(filepath.Join(s.cfg.Dir, releasesListPath))
+	if err != nil {
+		return releases
+	}
+	list, err := decodeReleases(data)
+	if err != nil {
+		return releases
+	}
+	for _, release := range list {
+		releases = append(releases, release.TagName)
+	}
+	return releases
+}
+
+func (s *server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	status := s.status
+	s.mu.Unlock()
+	status.Releases = s.mirroredReleases()
+	writeJSON(w, http.StatusOK, status)
+}
+
+// handleSync runs a sync now, even while held, and answers when it is done.
+func (s *server) handleSync(w http.ResponseWriter, r *http.Request) {
+	if !s.syncNow() {
+		http.Error(w, "a sync is already running", http.StatusConflict)
+		return
+	}
+	s.handleStatus(w, r)
+}
+
+func (s *server) handleHold(hold bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.status.Held = hold
+		s.mu.Unlock()
+		if hold {
+			log.Info().Msg("Upstream syncs held; stations keep the current mirror")
+		} else {
+			log.Info().Msg("Upstream syncs resumed")
+		}
+		s.handleStatus(w, r)
+	}
+}
+
+// handlePostReport stores a station's rollout report in the same layout as a shared
+// report directory.
+func (s *server) handlePostReport(w http.ResponseWriter, r *http.Request) {
+	var report RolloutReport
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxReportSize)).Decode(&report)
+	if err != nil {
+		http.Error(w, "invalid report: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if report.StationID == "" || report.Component == "" || report.Version == "" {
+		http.Error(w, "station_id, component and version are required", http.StatusBadRequest)
+		return
+	}
+	if report.At.IsZero() {
+		report.At = time.Now().UTC()
+	}
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	dir := reportDir(s.cfg.Reports, report.Component, report.Version)
+	err = os.MkdirAll(dir, 0755)
+	if err == nil {
+		err = os.WriteFile(filepath.Join(dir, unsafeReportChars.ReplaceAllString(report.StationID, "_")+".json"), data, 0644)
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to store rollout report")
+		http.Error(w, "failed to store report", http.StatusInternalServerError)
+		return
+	}
+	log.Info().Str("station", report.StationID).Str("component", report.Component).Str("version", report.Version).
+		Bool("ok", report.OK).Str("error", report.Error).Msg("Rollout report received")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleGetReports answers with the reports for one component and version, which is
+// what stations ask before taking it, or with every report when both are left out.
+func (s *server) handleGetReports(w http.ResponseWriter, r *http.Request) {
+	component, version := r.URL.Query().Get("component"), r.URL.Query().Get("version")
+	var reports []RolloutReport
+	var err error
+	switch {
+	case component != "" && version != "":
+		reports, err = readReportDir(reportDir(s.cfg.Reports, component, version))
+	case component == "" && version == "":
+		reports, err = s.allReports()
+	default:
+		http.Error(w, "give both component and version, or neither", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if reports == nil {
+		reports = []RolloutReport{}
+	}
+	writeJSON(w, http.StatusOK, reports)
+}
+
+func (s *server) allReports() ([]RolloutReport, error) {
+	var reports []RolloutReport
+	err := filepath.WalkDir(s.cfg.Reports, func(name string, entry fs.DirEntry, err error) error {
+		if err != nil || !entry.IsDir() || name == s.cfg.Reports {
+			return err
+		}
+		found, err := readReportDir(name)
+		reports = append(reports, found...)
+		return err
+	})
+	return reports, err
+}
+
+// handleFiles serves the mirror. Files get an ETag from their size and modification
+// time, like the file:// transport, so stations skip unchanged bookmarks and see new
+// versions for the staged rollout. Staging directories and other dotfiles are hidden.
+func (s *server) handleFiles(w http.ResponseWriter, r *http.Request) {
+	name := path.Clean("/" + r.URL.Path)
+	if strings.Contains(name, "/.") {
+		http.NotFound(w, r)
+		return
+	}
+	info, err := os.Stat(filepath.Join(s.cfg.Dir, filepath.FromSlash(name)))
+	if err == nil && info.Mode().IsRegular() {
+		w.Header().Set("ETag", fmt.Sprintf(`"%x-%x"`, info.Size(), info.ModTime().UnixNano()))
+	}
+	s.files.ServeHTTP(w, r)
+}
+
+// requireSecret lets a request through if it carries secret as a bearer token or, when
+// there is no secret, if it comes from a loopback address.
+func requireSecret(secret string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if secret == "" {
+			host, _, err := net.SplitHostPort(r.RemoteAddr)
+			ip := net.ParseIP(host)
+			if err != nil || ip == nil || !ip.IsLoopback() {
+				http.Error(w, "only accepted from the controller itself until a secret is configured", http.StatusForbidden)
+				return
+			}
+			next(w, r)
+			return
+		}
+		given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(secret)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "missing or wrong bearer token", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	_ = encoder.Encode(v)
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.code = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorder := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+		start := time.Now()
+		next.ServeHTTP(recorder, r)
+		log.Debug().Str("method", r.Method).Str("path", r.URL.Path).Str("remote", r.RemoteAddr).
+			Int("status", recorder.code).Dur("took", time.Since(start)).Msg("Request served")
+	})
+}
@@ -0,0 +1,225 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	pathLegacyStationID = ".station_id"
+	pathDMISerial       = "/sys/class/dmi/id/product_serial"
+)
+
+// ErrStationNotResolved is returned by a StationResolver that has no answer for this
+// machine, telling GetStationID to move on to the next resolver.
+var ErrStationNotResolved = errors.New("station ID not resolved")
+
+type StationResolver interface {
+	Name() string
+	Resolve() (string, error)
+}
+
+// DefaultStationResolvers returns the resolvers in the order GetStationID tries them.
+func DefaultStationResolvers(format StationIDFormat) []StationResolver {
+	return []StationResolver{
+		ConfigResolver{},
+		HostnameResolver{Pattern: format.HostnamePattern(), InventoryPath: paths.Inventory},
+		MACResolver{InventoryPath: paths.Inventory},
+		DMIResolver{InventoryPath: paths.Inventory, SerialPath: pathDMISerial},
+		PromptResolver{Format: format},
+	}
+}
+
+func GetStationID() (string, error) {
+	cfg, err := LoadConfig()
+	if err != nil {
+		return "", fmt.Errorf("failed to load config: %w", err)
+	}
+	return ResolveStationID(DefaultStationResolvers(cfg.StationFormat))
+}
+
+func ResolveStationID(resolvers []StationResolver) (string, error) {
+	for _, resolver := range resolvers {
+		ID, err := resolver.Resolve()
+		if errors.Is(err, ErrStationNotResolved) {
+			log.Debug().Str("resolver", resolver.Name()).Msg("Station ID resolver had no answer")
+			continue
+		}
+		if err != nil {
+			log.Warn().Err(err).Str("resolver", resolver.Name()).Msg("Station ID resolver failed")
+			continue
+		}
+
+		log.Debug().Str("resolver", resolver.Name()).Str("station_id", ID).Msg("Resolved station ID")
+		if _, ok := resolver.(ConfigResolver); ok {
+			return ID, nil
+		}
+
+		cfg, err := LoadConfig()
+		if err != nil {
+			return "", fmt.Errorf("failed to load config: %w", err)
+		}
+		err = cfg.Set("station_id", ID)
+		if err != nil {
+			log.Warn().Err(err).Str("resolver", resolver.Name()).Msg("Resolved station ID is invalid")
+			continue
+		}
+		err = SaveConfig(cfg)
+		if err != nil {
+			return "", fmt.Errorf("failed to save station ID: %w", err)
+		}
+		log.Info().Str("station_id", cfg.StationID).Str("resolver", resolver.Name()).Msg("Station ID saved successfully")
+		return cfg.StationID, nil
+	}
+	return "", fmt.Errorf("no resolver could determine the station ID")
+}
+
+// ConfigResolver reads the station ID from the station config, which also picks up
+// legacy .station_id and iceslab.conf values through migration.
+type ConfigResolver struct{}
+
+func (r ConfigResolver) Name() string { return "config" }
+
+func (r ConfigResolver) Resolve() (string, error) {
+	cfg, err := LoadConfig()
+	if err != nil {
+		return "", err
+	}
+	if cfg.StationID == "" {
+		return "", ErrStationNotResolved
+	}
+	return cfg.StationID, nil
+}
+
+// HostnameResolver matches the hostname against the inventory first and falls back
+// to extracting the ID from Pattern.
+type HostnameResolver struct {
+	Pattern       *regexp.Regexp
+	InventoryPath string
+}
+
+func (r HostnameResolver) Name() string { return "hostname" }
+
+func (r HostnameResolver) Resolve() (string, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", fmt.Errorf("failed to get hostname: %w", err)
+	}
+	if inventory, err := LoadInventory(r.InventoryPath); err == nil {
+		if station, ok := inventory.ByHostname(hostname); ok {
+			return station.ID, nil
+		}
+	}
+	match := r.Pattern.FindStringSubmatch(hostname)
+	if len(match) < 2 {
+		return "", ErrStationNotResolved
+	}
+	return match[1], nil
+}
+
+type MACResolver struct {
+	InventoryPath string
+}
+
+func (r MACResolver) Name() string { return "mac" }
+
+func (r MACResolver) Resolve() (string, error) {
+	inventory, err := LoadInventory(r.InventoryPath)
+	if os.IsNotExist(err) {
+		return "", ErrStationNotResolved
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to load inventory: %w", err)
+	}
+
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return "", fmt.Errorf("failed to list network interfaces: %w", err)
+	}
+	for _, iface := range interfaces {
+		mac := iface.HardwareAddr.String()
+		if mac == "" {
+			continue
+		}
+		if station, ok := inventory.ByMAC(mac); ok {
+			return station.ID, nil
+		}
+	}
+	return "", ErrStationNotResolved
+}
+
+type DMIResolver struct {
+	InventoryPath string
+	SerialPath    string
+}
+
+func (r DMIResolver) Name() string { return "dmi" }
+
+func (r DMIResolver) Resolve() (string, error) {
+	inventory, err := LoadInventory(r.InventoryPath)
+	if os.IsNotExist(err) {
+		return "", ErrStationNotResolved
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to load inventory: %w", err)
+	}
+
+	bytes, err := os.ReadFile(r.SerialPath)
+	if err != nil {
+		// product_serial is root-only and missing on some hardware
+		return "", ErrStationNotResolved
+	}
+	serial := strings.TrimSpace(string(bytes))
+	if station, ok := inventory.BySerial(serial); ok && serial != "" {
+		return station.ID, nil
+	}
+	return "", ErrStationNotResolved
+}
+
+// PromptResolver asks on stdin, and only when stdin is a terminal so that runs from
+// systemd units never block waiting for input.
+type PromptResolver struct {
+	Format StationIDFormat
+}
+
+func (r PromptResolver) Name() string { return "prompt" }
+
+func (r PromptResolver) Resolve() (string, error) {
+	if !stdinIsTerminal() {
+		return "", ErrStationNotResolved
+	}
+	log.Info().Msg("Station ID could not be detected; prompting user for station ID")
+	ID, err := PromptForStationID(r.Format)
+	if err != nil {
+		return "", fmt.Errorf("failed to prompt for station ID: %w", err)
+	}
+	return ID, nil
+}
+
+func PromptForStationID(format StationIDFormat) (string, error) {
+	example, _ := format.Normalize("1")
+	for {
+		var stationNum string
+		log.Info().Msgf("Please enter the station ID (e.g., %s):", example)
+		_, err := fmt.Scanln(&stationNum)
+		if err != nil {
+			return "", err
+		}
+		ID, err := format.Normalize(stationNum)
+		if err != nil {
+			log.Warn().Err(err).Msg("Invalid station ID; try again")
+			continue
+		}
+		return ID, nil
+	}
+}
+
+func stdinIsTerminal() bool {
+	return isTerminal(os.Stdin)
+}
@@ -0,0 +1,129 @@
+package utils
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	defaultStationIDWidth = 2
+	defaultHostnamePrefix = "iceslab-"
+	maxStationIDLength    = 16
+)
+
+var stationIDPattern = regexp.MustCompile(`^([A-Z]*)(\d+)$`)
+
+// StationIDFormat controls how station IDs are validated and normalized. With the zero
+// value IDs are purely numeric and zero-padded to two digits ("7" becomes "07").
+type StationIDFormat struct {
+	// Width zero-pads the numeric part of the ID.
+	Width int `yaml:"width,omitempty" json:"width,omitempty"`
+	// Prefix is a room letter prepended to bare numbers, e.g. "B" turns "12" into "B12".
+	Prefix string `yaml:"prefix,omitempty" json:"prefix,omitempty"`
+	// Alphanumeric allows letter prefixes such as "B12" for multi-room labs.
+	Alphanumeric bool `yaml:"alphanumeric,omitempty" json:"alphanumeric,omitempty"`
+	// HostnamePrefix is prepended to the ID to form the hostname.
+	HostnamePrefix string `yaml:"hostname_prefix,omitempty" json:"hostname_prefix,omitempty"`
+}
+
+func (f StationIDFormat) width() int {
+	if f.Width <= 0 {
+		return defaultStationIDWidth
+	}
+	return f.Width
+}
+
+func (f StationIDFormat) hostnamePrefix() string {
+	if f.HostnamePrefix == "" {
+		return defaultHostnamePrefix
+	}
+	return f.HostnamePrefix
+}
+
+// Normalize validates raw and returns it in canonical form.
+func (f StationIDFormat) Normalize(raw string) (string, error) {
+	ID := strings.ToUpper(strings.TrimSpace(raw))
+	if ID == "" {
+		return "", fmt.Errorf("station ID is empty")
+	}
+	if len(ID) > maxStationIDLength {
+		return "", fmt.Errorf("station ID %q is longer than %d characters", raw, maxStationIDLength)
+	}
+
+	match := stationIDPattern.FindStringSubmatch(ID)
+	if match == nil {
+		return "", fmt.Errorf("station ID %q must be digits optionally preceded by letters", raw)
+	}
+	letters, digits := match[1], match[2]
+
+	prefix := strings.ToUpper(f.Prefix)
+	switch {
+	case letters == "" && prefix != "":
+		letters = prefix
+	case letters != "" && prefix != "" && letters != prefix:
+		return "", fmt.Errorf("station ID %q does not match required prefix %q", raw, prefix)
+	}
+	if letters != "" && !f.Alphanumeric && prefix == "" {
+		return "", fmt.Errorf("station ID %q contains letters but alphanumeric IDs are disabled", raw)
+	}
+
+	number, err := strconv.Atoi(digits)
+	if err != nil {
+		return "", fmt.Errorf("invalid station number in %q: %w", raw, err)
+	}
+	if number <= 0 {
+		return "", fmt.Errorf("station number in %q must be positive", raw)
+	}
+	return fmt.Sprintf("%s%0*d", letters, f.width(), number), nil
+}
+
+// Hostname returns the hostname for a normalized station ID.
+func (f StationIDFormat) Hostname(ID string) string {
+	return f.hostnamePrefix() + strings.ToLower(ID)
+}
+
+// HostnamePattern matches hostnames produced by Hostname and captures the ID.
+func (f StationIDFormat) HostnamePattern() *regexp.Regexp {
+	return regexp.MustCompile(`^` + regexp.QuoteMeta(f.hostnamePrefix()) + `([A-Za-z]*\d+)$`)
+}
+
+// StationNumber extracts the numeric part of a station ID, so "B12" and "12" are both 12.
+func StationNumber(ID string) (int, bool) {
+	match := stationIDPattern.FindStringSubmatch(strings.ToUpper(ID))
+	if match == nil {
+		return 0, false
+	}
+	number, err := strconv.Atoi(match[2])
+	if err != nil {
+		return 0, false
+	}
+	return number, true
+}
+
+// SetHostname sets the running and persistent hostname without going through hostnamectl.
+func SetHostname(hostname string) error {
+	if len(hostname) > 64 {
+		return fmt.Errorf("hostname %q is too long", hostname)
+	}
+	if planEffect(EffectHostname, hostname, "sethostname and "+paths.Hostname) {
+		return nil
+	}
+	// Only touch the running kernel's hostname when managing the real root
+	if paths.Root == defaultRoot {
+		err := syscall.Sethostname([]byte(hostname))
+		if err != nil {
+			return fmt.Errorf("failed to set hostname: %w", err)
+		}
+	}
+	err := writeFile(paths.Hostname, []byte(hostname+"\n"), 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", paths.Hostname, err)
+	}
+	log.Info().Str("hostname", hostname).Msg("Hostname set")
+	return nil
+}
@@ -0,0 +1,196 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Units installed by the guest template script and the service assets.
+var statusUnits = []string{
+	"guest-session-management.service",
+	"guest-login.service",
+	"guest-logout.service",
+	UpdateUnit + ".timer",
+}
+
+// StatusReport is a snapshot of a station's state. The JSON form is meant for scripts
+// and fleet tooling, so fields are only ever added, never renamed.
+type StatusReport struct {
+	GeneratedAt time.Time `json:"generated_at"`
+	Hostname    string    `json:"hostname"`
+	StationID   string    `json:"station_id"`
+
+	Binary BinaryStatus `json:"binary"`
+	Assets AssetsStatus `json:"assets"`
+
+	BookmarksETag      string     `json:"bookmarks_etag"`
+	BookmarksUpdatedAt *time.Time `json:"bookmarks_updated_at"`
+
+	// Rollout is this station's last staged rollout report, if it took part in one.
+	Rollout *RolloutReport `json:"rollout,omitempty"`
+
+	PostInstallComplete bool              `json:"post_install_complete"`
+	GuestUserPresent    bool              `json:"guest_user_present"`
+	Units               map[string]string `json:"units"`
+	Policies            []PolicyStatus    `json:"policies"`
+
+	Errors []string `json:"errors,omitempty"`
+}
+
+type BinaryStatus struct {
+	Version string `json:"version"`
+	Path    string `json:"path"`
+	Hash    string `json:"hash"`
+}
+
+type AssetsStatus struct {
+	Hash         string `json:"hash"`
+	ManifestHash string `json:"manifest_hash"`
+	Matches      bool   `json:"matches"`
+}
+
+type PolicyStatus struct {
+	Path     string `json:"path"`
+	Expected string `json:"expected"`
+	Matches  bool   `json:"matches"`
+}
+
+// CollectStatus gathers the report. Individual probes that fail are recorded in
+// Errors rather than aborting the whole report.
+func CollectStatus(version string) StatusReport {
+	report := StatusReport{
+		GeneratedAt: time.Now().UTC(),
+		Units:       map[string]string{},
+	}
+	fail := func(what string, err error) {
+		report.Errors = append(report.Errors, fmt.Sprintf("%s: %v", what, err))
+	}
+
+	report.Hostname, _ = os.Hostname()
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		fail("config", err)
+	}
+	report.StationID = cfg.StationID
+	report.PostInstallComplete = cfg.PostInstallComplete
+
+	report.Binary.Version = version
+	execPath, err := os.Executable()
+	if err != nil {
+		fail("executable", err)
+	} else {
+		report.Binary.Path = execPath
+		report.Binary.Hash, err = HashFile(execPath)
+		if err != nil {
+			fail("binary hash", err)
+		}
+	}
+
+	report.Assets.Hash, err = HashDirectory(paths.Assets)
+	if err != nil {
+		fail("assets hash", err)
+	}
+	manifest, err := LoadManifest(paths.Manifest)
+	if err != nil {
+		fail("manifest", err)
+	} else {
+		report.Assets.ManifestHash = manifest.AssetsHash()
+		diff, err := VerifyManifest(manifest, paths.Assets)
+		if err != nil {
+			fail("verify assets", err)
+		}
+		report.Assets.Matches = err == nil && diff.Clean()
+	}
+
+	etag, err := os.ReadFile(paths.BookmarksETag)
+	if err == nil {
+		report.BookmarksETag = strings.TrimSpace(string(etag))
+		if info, err := os.Stat(paths.BookmarksETag); err == nil {
+			modTime := info.ModTime().UTC()
+			report.BookmarksUpdatedAt = &modTime
+		}
+	}
+
+	if data, err := os.ReadFile(paths.RolloutReport); err == nil {
+		var rollout RolloutReport
+		err = json.Unmarshal(data, &rollout)
+		if err != nil {
+			fail("rollout report", err)
+		} else {
+			report.Rollout = &rollout
+		}
+	}
+
+	_, err = user.Lookup("guest")
+	report.GuestUserPresent = err == nil
+
+	for _, unit := range statusUnits {
+		// is-enabled exits non-zero for disabled units but still prints the state
+		state, _ := ShellOutput("systemctl is-enabled " + unit)
+		if state == "" {
+			state = "unknown"
+		}
+		report.Units[unit] = state
+	}
+
+	for _, expected := range []string{paths.FirefoxPolicies, paths.ChromiumPolicies} {
+		installed := paths.InstalledPath(expected)
+		policy := PolicyStatus{Path: installed, Expected: expected}
+		expectedHash, err := HashFile(expected)
+		if err != nil {
+			fail("policy "+expected, err)
+		} else if installedHash, err := HashFile(installed); err == nil {
+			policy.Matches = installedHash == expectedHash
+		}
+		report.Policies = append(report.Policies, policy)
+	}
+
+	return report
+}
+
+func PrintStatus(w io.Writer, report StatusReport) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "station_id\t%s\n", report.StationID)
+	fmt.Fprintf(tw, "hostname\t%s\n", report.Hostname)
+	fmt.Fprintf(tw, "version\t%s\n", report.Binary.Version)
+	fmt.Fprintf(tw, "binary\t%s (%s)\n", report.Binary.Path, shortHash(report.Binary.Hash))
+	fmt.Fprintf(tw, "assets\t%s (manifest %s, match: %t)\n", shortHash(report.Assets.Hash), shortHash(report.Assets.ManifestHash), report.Assets.Matches)
+	updated := "never"
+	if report.BookmarksUpdatedAt != nil {
+		updated = report.BookmarksUpdatedAt.Format(time.RFC3339)
+	}
+	fmt.Fprintf(tw, "bookmarks\tetag %s, updated %s\n", report.BookmarksETag, updated)
+	if rollout := report.Rollout; rollout != nil {
+		result := "ok"
+		if !rollout.OK {
+			result = "failed: " + rollout.Error
+		}
+		fmt.Fprintf(tw, "rollout\t%s %s %s at %s\n", rollout.Component, rollout.Version, result, rollout.At.Format(time.RFC3339))
+	}
+	fmt.Fprintf(tw, "post_install_complete\t%t\n", report.PostInstallComplete)
+	fmt.Fprintf(tw, "guest_user_present\t%t\n", report.GuestUserPresent)
+	for _, unit := range statusUnits {
+		fmt.Fprintf(tw, "unit %s\t%s\n", unit, report.Units[unit])
+	}
+	for _, policy := range report.Policies {
+		fmt.Fprintf(tw, "policy %s\tmatch: %t\n", policy.Path, policy.Matches)
+	}
+	for _, e := range report.Errors {
+		fmt.Fprintf(tw, "error\t%s\n", e)
+	}
+	return tw.Flush()
+}
+
+func shortHash(hash string) string {
+	if len(hash) > 12 {
+		return hash[:12]
+	}
+	return hash
+}
@@ -0,0 +1,166 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// errChangedSinceInstall marks an installed file someone else edited since iceslab
+// last wrote it, which uninstall leaves alone unless forced.
+var errChangedSinceInstall = errors.New("changed since install")
+
+// Uninstall reverts the install record in reverse order. Files changed since install
+// are left alone unless force is set, and nothing outside the record is touched.
+func Uninstall(force bool) error {
+	record, err := LoadInstallRecord()
+	if os.IsNotExist(err) {
+		return fmt.Errorf("no install record at %s; refusing to remove anything iceslab did not create", recordPath())
+	}
+	if err != nil {
+		return err
+	}
+
+	// Kept by update self for rollback; not part of the install itself
+	err = removeFile(paths.PreviousBinary)
+	if err != nil && !os.IsNotExist(err) {
+		log.Warn().Err(err).Msg("Failed to remove previous binary")
+	}
+
+	var failed, skipped int
+	var stateDirs []string
+	unitsChanged := false
+	for i := len(record.Entries) - 1; i >= 0; i-- {
+		entry := record.Entries[i]
+		// The record lives in the state directory, so it and its parents go last
+		if entry.Kind == RecordDir && isAncestorOrSelf(entry.Path, paths.StateDir) {
+			stateDirs = append(stateDirs, entry.Path)
+			continue
+		}
+		err := revertEntry(entry, force)
+		if errors.Is(err, errChangedSinceInstall) {
+			skipped++
+			log.Warn().Str("path", entry.Path).Msg("File changed since install; leaving it. Re-run with -force to revert it anyway")
+			continue
+		}
+		if err != nil {
+			failed++
+			log.Error().Err(err).Str("kind", entry.Kind).Str("path", entry.Path).Str("name", entry.Name).Msg("Failed to revert")
+			continue
+		}
+		if entry.Kind == RecordUnit {
+			unitsChanged = true
+		}
+	}
+
+	if unitsChanged {
+		err = RunShellCommand("systemctl daemon-reload")
+		if err != nil {
+			log.Warn().Err(err).Msg("Failed to reload systemd")
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d recorded changes could not be reverted; the install record was kept", failed, len(record.Entries))
+	}
+	if skipped > 0 {
+		// The backups are the only copy of the originals of files left in place
+		return fmt.Errorf("%d files changed since install were left in place; the install record and backups were kept for 'uninstall -force'", skipped)
+	}
+
+	err = removeAll(backupDir())
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to remove backups")
+	}
+	err = removeFile(recordPath())
+	if err != nil {
+		return fmt.Errorf("failed to remove install record: %w", err)
+	}
+	// Restoring backups refreshed hashes in the record that is now gone
+	deferredRecord.changed = false
+	for _, dir := range stateDirs {
+		err = removeEmptyDir(dir)
+		if err != nil {
+			log.Warn().Err(err).Str("path", dir).Msg("Failed to remove state directory")
+		}
+	}
+	log.Info().Int("entries", len(record.Entries)).Msg("Uninstall completed")
+	return nil
+}
+
+func revertEntry(entry RecordEntry, force bool) error {
+	switch entry.Kind {
+	case RecordFile:
+		hash, err := HashFile(entry.Path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err == nil && entry.Hash != "" && hash != entry.Hash && !force {
+			return fmt.Errorf("%s %w", entry.Path, errChangedSinceInstall)
+		}
+		if entry.Backup != "" {
+			original, err := os.ReadFile(entry.Backup)
+			if err != nil {
+				return fmt.Errorf("failed to read backup: %w", err)
+			}
+			log.Info().Str("path", entry.Path).Msg("Restoring original file")
+			return writeFile(entry.Path, original, entry.Mode)
+		}
+		if os.IsNotExist(err) {
+			return nil
+		}
+		log.Info().Str("path", entry.Path).Msg("Removing file")
+		return removeFile(entry.Path)
+	case RecordDir:
+		return removeEmptyDir(entry.Path)
+	case RecordTree:
+		log.Info().Str("path", entry.Path).Msg("Removing directory tree")
+		return removeAll(entry.Path)
+	case RecordUnit:
+		log.Info().Str("unit", entry.Name).Msg("Disabling unit")
+		return RunShellCommand("systemctl disable " + entry.Name)
+	case RecordUser:
+		log.Info().Str("user", entry.Name).Msg("Removing user")
+		_ = RunShellCommand("loginctl terminate-user " + entry.Name)
+		return RunShellCommand("userdel --remove " + entry.Name)
+	default:
+		return fmt.Errorf("unknown record kind %q", entry.Kind)
+	}
+}
+
+func isAncestorOrSelf(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+func removeFile(path string) error {
+	if planEffect(EffectRemove, path, "") {
+		return nil
+	}
+	err := os.Remove(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// removeEmptyDir removes a directory iceslab created, unless something else has
+// since put files in it.
+func removeEmptyDir(path string) error {
+	entries, err := os.ReadDir(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 && !dryRun {
+		log.Warn().Str("path", filepath.Clean(path)).Int("entries", len(entries)).Msg("Directory created by install is not empty; leaving it")
+		return nil
+	}
+	return removeFile(path)
+}
@@ -1,30 +1,61 @@
 package utils
 
 import (
+	"context"
 	"net/http"
+	"path/filepath"
+	"strings"
 )
 
 // https://api.github.com/repos/sstark-mason/iceslab/releases/latest
 // https://api.github.com/repos/sstark-mason/iceslab/releases/tags/bookmarks-latest
 
 const (
-	owner                     = "sstark-mason"
-	repo                      = "iceslab"
-	branch                    = "main"
-	latestBookmarksReleaseURL = "https://github.com/sstark-mason/iceslab/releases/download/bookmarks-latest/bookmarks.zip"
-	latestSourceURL           = "https://github.com/sstark-mason/iceslab/zipball/main"
+	owner  = "sstark-mason"
+	repo   = "iceslab"
+	branch = "main"
+
+	defaultUpdateURL = "https://github.com/sstark-mason/iceslab"
 )
 
 type Client struct {
-	http   *http.Client
-	apiURL string
-	token  string
+	ctx     context.Context
+	http    *http.Client
+	apiURL  string
+	baseURL string
+	token   string
 }
 
-func NewClient(token string) *Client {
+// NewClient downloads from the update_url in the config, or from GitHub. Every
+// request is abandoned when ctx is cancelled, e.g. when systemd stops the unit.
+func NewClient(ctx context.Context, token string) *Client {
 	return &Client{
-		http:   &http.Client{},
-		apiURL: "https://api.github.com",
-		token:  token,
+		ctx:     ctx,
+		http:    &http.Client{Transport: newTransport()},
+		apiURL:  "https://api.github.com",
+		baseURL: configuredUpdateURL(),
+		token:   token,
+	}
+}
+
+func (c *Client) url(path string) string {
+	return c.baseURL + "/" + path
+}
+
+func configuredUpdateURL() string {
+	cfg, err := LoadConfig()
+	if err != nil || cfg.UpdateURL == "" {
+		return defaultUpdateURL
+	}
+	return NormalizeUpdateURL(cfg.UpdateURL)
+}
+
+// NormalizeUpdateURL turns a plain directory such as a USB mount into a file:// URL
+// and drops any trailing slash.
+func NormalizeUpdateURL(url string) string {
+	url = strings.TrimSpace(url)
+	if filepath.IsAbs(url) {
+		url = "file://" + filepath.ToSlash(filepath.Clean(url))
 	}
+	return strings.TrimRight(url, "/")
 }
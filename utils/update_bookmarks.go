@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"net/http"
@@ -9,26 +10,21 @@ import (
 	"github.com/rs/zerolog/log"
 )
 
-const (
-	pathBookmarks        = "assets/bookmarks/"
-	pathFirefoxPolicies  = "assets/etc/firefox/policies/policies.json"
-	pathChromiumPolicies = "assets/etc/chromium/policies/managed/policies.json"
-)
-
 func InsertBookmarksInPolicies(stationID string) error {
 	log.Info().Msg("Installing bookmarks")
 
-	bookmarks, err := CollectBookmarks("assets/bookmarks/", stationID)
+	station := LookupStation(stationID)
+	bookmarks, err := CollectBookmarks(paths.Bookmarks, station)
 	if err != nil {
 		return fmt.Errorf("failed to collect bookmarks: %w", err)
 	}
 
-	err = InsertBookmarks("firefox", pathFirefoxPolicies, bookmarks)
+	err = InsertBookmarks("firefox", paths.FirefoxPolicies, bookmarks)
 	if err != nil {
 		return fmt.Errorf("failed to insert firefox bookmarks: %w", err)
 	}
 
-	err = InsertBookmarks("chromium", pathChromiumPolicies, bookmarks)
+	err = InsertBookmarks("chromium", paths.ChromiumPolicies, bookmarks)
 	if err != nil {
 		return fmt.Errorf("failed to insert chromium bookmarks: %w", err)
 	}
@@ -38,8 +34,34 @@ func InsertBookmarksInPolicies(stationID string) error {
 
 }
 
-func (c *Client) UpdateBookmarkYamls() error {
-	localETagBytes, err := os.ReadFile(".etag_bookmarks")
+func InsertNetworkInPolicies() error {
+	settings, err := LoadBrowserNetwork(paths.BrowserNetwork)
+	if os.IsNotExist(err) {
+		log.Info().Str("path", paths.BrowserNetwork).Msg("No browser network config found; leaving proxy and DNS-over-HTTPS policies unchanged")
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to load browser network config: %w", err)
+	}
+
+	err = InsertNetworkSettings("firefox", paths.FirefoxPolicies, settings)
+	if err != nil {
+		return fmt.Errorf("failed to insert firefox network settings: %w", err)
+	}
+
+	err = InsertNetworkSettings("chromium", paths.ChromiumPolicies, settings)
+	if err != nil {
+		return fmt.Errorf("failed to insert chromium network settings: %w", err)
+	}
+
+	log.Info().Str("proxy_mode", settings.Proxy.Mode).Msg("Browser network settings installed successfully")
+	return nil
+}
+
+// UpdateBookmarkYamls replaces the bookmarks directory with the one published for
+// the resolved channel and records the ref it came from.
+func (c *Client) UpdateBookmarkYamls(resolution Resolution) error {
+	localETagBytes, err := os.ReadFile(paths.BookmarksETag)
 	localETag := ""
 	if err == nil {
 		localETag = string(localETagBytes)
@@ -48,89 +70,94 @@ func (c *Client) UpdateBookmarkYamls() error {
 		log.Info().Msg("No local bookmarks ETag found; treating as first run")
 	}
 
-	zipData, latestETag, err := c.FetchLatestBookmarks(localETag)
+	bundle, err := c.FetchBookmarks(resolution, localETag)
 	if err != nil {
-		return fmt.Errorf("failed to fetch latest bookmarks: %w", err)
+		return fmt.Errorf("failed to fetch bookmarks: %w", err)
 	}
 
-	if zipData == nil {
-		log.Info().Msg("Bookmarks are up to date; no update needed")
-		return nil
+	if bundle == nil {
+		log.Info().Str("ref", resolution.Ref).Msg("Bookmarks are up to date; no update needed")
+		return writeFile(paths.BookmarksVersion, []byte(resolution.Ref+"\n"), 0644)
 	}
-
-	pathOldBookmarks := "assets/bookmarks_old/"
-	backedUpOldBookmarks := false
-
-	if _, err := os.Stat(pathBookmarks); err == nil {
-		log.Debug().Msg("Existing bookmarks directory found; backing up before update")
-
-		err = MoveFile(pathBookmarks, pathOldBookmarks)
+	defer bundle.Close()
+	latestETag := bundle.ETag
+
+	var zipData io.ReaderAt = bundle
+	size := bundle.Size
+	if resolution.IsCommit {
+		// A commit has no bookmarks release, so cut the directory out of its zipball
+		data, err := zipSubtree(bundle, bundle.Size, "assets/bookmarks")
 		if err != nil {
-			log.Warn().Err(err).Msg("Failed to move existing bookmarks to backup directory")
+			return fmt.Errorf("failed to fetch bookmarks: %w", err)
 		}
-		backedUpOldBookmarks = true
+		zipData, size = bytes.NewReader(data), int64(len(data))
 	}
 
-	err = unzipInto("assets/bookmarks/", zipData)
+	err = extractZip(zipData, size, paths.Bookmarks, 0)
 	if err != nil {
-		if backedUpOldBookmarks {
-			log.Warn().Err(err).Msg("Failed to unzip new bookmarks; attempting to restore old bookmarks from backup")
-			restoreErr := MoveFile(pathOldBookmarks, pathBookmarks)
-			if restoreErr != nil {
-				log.Warn().Err(restoreErr).Msg("Failed to restore old bookmarks after unzip failure")
-			} else {
-				log.Info().Msg("Restored old bookmarks after unzip failure")
-			}
-		}
 		return fmt.Errorf("failed to unzip bookmarks: %w", err)
 	}
-
-	// Clean up any old bookmarks files that might be left over from previous versions
-	if backedUpOldBookmarks {
-		err = os.RemoveAll(pathOldBookmarks)
-		if err != nil {
-			log.Warn().Err(err).Msg("Failed to clean up old bookmarks backup directory")
-		}
+	// The files install recorded one by one are gone now; uninstall removes the lot
+	err = recordOwnedTree(paths.Bookmarks)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to update install record")
 	}
 
-	err = os.WriteFile(".etag_bookmarks", []byte(latestETag), 0644)
+	err = writeFile(paths.BookmarksETag, []byte(latestETag), 0644)
 	if err != nil {
 		return fmt.Errorf("failed to save latest bookmarks ETag: %w", err)
 	}
 
-	log.Info().Str("latest_bookmarks_etag", latestETag).Msg("Bookmarks updated and ETag saved locally")
+	err = writeFile(paths.BookmarksVersion, []byte(resolution.Ref+"\n"), 0644)
+	if err != nil {
+		return fmt.Errorf("failed to save bookmarks version: %w", err)
+	}
+
+	log.Info().Str("ref", resolution.Ref).Str("latest_bookmarks_etag", latestETag).Msg("Bookmarks updated and ETag saved locally")
 	return nil
 }
 
-func (c *Client) FetchLatestBookmarks(localETag string) ([]byte, string, error) {
-	// Returns bookmarks zip data, latest ETag, error.
-	latestETag := localETag
-	request, err := http.NewRequest("GET", latestBookmarksReleaseURL, nil)
+// FetchBookmarks downloads the channel's bookmarks bundle, or returns nil when its
+// ETag is still localETag. A released bundle is checked against the bookmarks.zip.sha256
+// published beside it before anything is extracted.
+func (c *Client) FetchBookmarks(resolution Resolution, localETag string) (*downloadedFile, error) {
+	bundle, err := c.download(c.url(resolution.bookmarksPath()), localETag)
+	if err != nil || bundle == nil || resolution.IsCommit {
+		return bundle, err
+	}
+	expected, err := c.publishedHash(resolution, "bookmarks.zip")
+	if err == nil && expected != "" {
+		err = bundle.verify("bookmarks.zip", expected)
+	}
 	if err != nil {
-		return nil, latestETag, err
+		bundle.Close()
+		return nil, err
 	}
+	return bundle, nil
+}
 
+// headBookmarks asks, without downloading it, for the headers of the channel's
+// bookmarks bundle. The status is 304 when its ETag is still localETag.
+func (c *Client) headBookmarks(resolution Resolution, localETag string) (*http.Response, error) {
+	url := c.url(resolution.bookmarksPath())
+	request, err := http.NewRequest(http.MethodHead, url, nil)
+	if err != nil {
+		return nil, err
+	}
 	if localETag != "" {
 		request.Header.Set("If-None-Match", localETag)
 	}
-
-	response, err := c.http.Do(request)
+	response, err := c.do(request)
 	if err != nil {
-		return nil, latestETag, err
+		return nil, err
 	}
-	defer response.Body.Close()
-
+	response.Body.Close()
 	switch response.StatusCode {
-	case http.StatusNotModified:
-		return nil, latestETag, nil
-	case http.StatusOK:
-		zipData, err := io.ReadAll(response.Body)
-		if err != nil {
-			return nil, latestETag, fmt.Errorf("failed to read bookmarks zip data: %w", err)
-		}
-		latestETag = response.Header.Get("ETag")
-		return zipData, latestETag, nil
+	case http.StatusOK, http.StatusNotModified:
+		return response, nil
+	case http.StatusNotFound:
+		return nil, fmt.Errorf("%w: %s", errNotFound, url)
 	default:
-		return nil, latestETag, fmt.Errorf("unexpected status code: %d", response.StatusCode)
+		return nil, fmt.Errorf("unexpected status code: %d", response.StatusCode)
 	}
 }
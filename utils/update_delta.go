@@ -0,0 +1,255 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/rs/zerolog/log"
+)
+
+// sourceManifestAsset lists every file of the release's source tree with its hash,
+// the same tree the zipball holds.
+const sourceManifestAsset = "source-manifest.yaml"
+
+// maxDeltaFiles is where one request per changed file stops being cheaper than the zipball.
+const maxDeltaFiles = 50
+
+// errNoDelta means the source has to be updated from the full zipball.
+var errNoDelta = errors.New("no delta update possible")
+
+// sourceDelta is what differs between the installed source and a release's manifest.
+type sourceDelta struct {
+	changed   []ManifestFile
+	chmod     []ManifestFile
+	removed   []string
+	download  int64
+	totalSize int64
+}
+
+func diffSource(local, remote Manifest) (sourceDelta, error) {
+	var delta sourceDelta
+	for _, file := range remote.Files {
+		if _, err := archivePath(file.Path, 0); err != nil {
+			return delta, err
+		}
+		delta.totalSize += file.Size
+		have, ok := local.File(file.Path)
+		switch {
+		case !ok || have.Hash != file.Hash:
+			delta.changed = append(delta.changed, file)
+			delta.download += file.Size
+		case have.Mode != file.Mode:
+			delta.chmod = append(delta.chmod, file)
+		}
+	}
+	for _, file := range local.Files {
+		if _, ok := remote.File(file.Path); !ok {
+			delta.removed = append(delta.removed, file.Path)
+		}
+	}
+	return delta, nil
+}
+
+// updateSourceDelta brings the installed source to the release by downloading only
+// the files whose hash differs from the release's source manifest. The result is
+// assembled in a staging copy and swapped in like a full extract. It returns an error
+// wrapping errNoDelta when the full zipball is the better (or only) way.
+func (c *Client) updateSourceDelta(resolution Resolution) error {
+	if resolution.IsCommit {
+		return fmt.Errorf("%w: commits publish no source manifest", errNoDelta)
+	}
+	if readVersionFile(paths.SourceVersion) == "" {
+		return fmt.Errorf("%w: no source installed yet", errNoDelta)
+	}
+	remote, err := c.sourceManifest(resolution)
+	if errors.Is(err, errNotFound) {
+		return fmt.Errorf("%w: release %s publishes no source manifest", errNoDelta, resolution.Ref)
+	}
+	if err != nil {
+		return err
+	}
+	local, err := GenerateManifest(os.DirFS(paths.Source), "", "", nil)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errNoDelta, err)
+	}
+	delta, err := diffSource(local, remote)
+	if err != nil {
+		return err
+	}
+	if len(delta.changed) > maxDeltaFiles || delta.download*2 > delta.totalSize {
+		return fmt.Errorf("%w: %d of %d files changed", errNoDelta, len(delta.changed), len(remote.Files))
+	}
+	if len(delta.changed)+len(delta.chmod)+len(delta.removed) == 0 {
+		log.Info().Str("ref", resolution.Ref).Msg("Source is already up to date")
+		return nil
+	}
+	if planEffect(EffectWrite, paths.Source, fmt.Sprintf("delta update: %d changed, %d removed, %d bytes", len(delta.changed), len(delta.removed), delta.download)) {
+		return nil
+	}
+
+	staging, err := os.MkdirTemp(filepath.Dir(paths.Source), "."+filepath.Base(paths.Source)+".staging-")
+	if err != nil {
+		return fmt.Errorf("failed to create staging directory: %w", err)
+	}
+	defer os.RemoveAll(staging)
+	err = os.Chmod(staging, 0755)
+	if err != nil {
+		return err
+	}
+	err = copyTree(paths.Source, staging)
+	if err != nil {
+		return fmt.Errorf("failed to copy source for staging: %w", err)
+	}
+
+	for _, file := range delta.changed {
+		err = c.downloadSourceFile(resolution, file, filepath.Join(staging, filepath.FromSlash(file.Path)))
+		if err != nil {
+			return err
+		}
+	}
+	for _, file := range delta.chmod {
+		err = os.Chmod(filepath.Join(staging, filepath.FromSlash(file.Path)), manifestPerm(file))
+		if err != nil {
+			return err
+		}
+	}
+	for _, name := range delta.removed {
+		err = os.Remove(filepath.Join(staging, filepath.FromSlash(name)))
+		if err != nil {
+			return err
+		}
+	}
+
+	err = swapDir(staging, paths.Source)
+	if err != nil {
+		return fmt.Errorf("failed to move %s into place: %w", paths.Source, err)
+	}
+	log.Info().Str("ref", resolution.Ref).Int("changed", len(delta.changed)).Int("removed", len(delta.removed)).
+		Int64("bytes", delta.download).Int64("full_size", delta.totalSize).Msg("Source updated from changed files only")
+	return nil
+}
+
+// sourceManifest fetches the release's source manifest. It returns an error wrapping
+// errNotFound when the release, like any commit, publishes none.
+func (c *Client) sourceManifest(resolution Resolution) (Manifest, error) {
+	if resolution.IsCommit {
+		return Manifest{}, fmt.Errorf("%w: commits publish no source manifest", errNotFound)
+	}
+	data, _, err := c.fetchIfChanged(c.url(resolution.releaseAssetPath(sourceManifestAsset)), "")
+	if err != nil {
+		return Manifest{}, fmt.Errorf("failed to fetch source manifest: %w", err)
+	}
+	return ParseManifest(data)
+}
+
+// verifySource checks an unpacked source tree against the release's manifest: every
+// file present with the right hash and mode, and nothing else.
+func verifySource(dir string, manifest Manifest) error {
+	tree, err := GenerateManifest(os.DirFS(dir), "", "", nil)
+	if err != nil {
+		return err
+	}
+	delta, err := diffSource(tree, manifest)
+	if err != nil {
+		return err
+	}
+	if len(delta.changed)+len(delta.chmod)+len(delta.removed) > 0 {
+		return fmt.Errorf("%w: source zip does not match the source manifest: %d files differ, %d modes differ, %d extra files",
+			errChecksumMismatch, len(delta.changed), len(delta.chmod), len(delta.removed))
+	}
+	return nil
+}
+
+// downloadSourceFile fetches one file of the release's source tree and writes it to
+// target once its hash matches the manifest.
+func (c *Client) downloadSourceFile(resolution Resolution, file ManifestFile, target string) error {
+	if file.Size > maxArchiveFileSize {
+		return fmt.Errorf("%w: %s is larger than %d bytes", errUnsafeArchive, file.Path, maxArchiveFileSize)
+	}
+	downloaded, err := c.download(c.url(resolution.rawPath(file.Path)), "")
+	if err != nil {
+		return fmt.Errorf("failed to download %s: %w", file.Path, err)
+	}
+	defer downloaded.Close()
+	err = downloaded.verify(file.Path, file.Hash)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, manifestPerm(file))
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	_, err = io.Copy(out, downloaded)
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", file.Path, err)
+	}
+	err = out.Chmod(manifestPerm(file))
+	if err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// manifestPerm applies the same rules as archive extraction to a manifest's mode.
+func manifestPerm(file ManifestFile) fs.FileMode {
+	mode, err := strconv.ParseUint(file.Mode, 8, 32)
+	if err != nil {
+		return 0644
+	}
+	return archivePerm(fs.FileMode(mode))
+}
+
+// copyTree copies the regular files and directories under src into dst, keeping modes.
+func copyTree(src, dst string) error {
+	return filepath.WalkDir(src, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case entry.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm())
+		case info.Mode().IsRegular():
+			return copyRegularFile(path, target, info.Mode().Perm())
+		default:
+			return fmt.Errorf("%s is not a regular file or directory", path)
+		}
+	})
+}
+
+func copyRegularFile(src, dst string, perm fs.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	_, err = io.Copy(out, in)
+	if err != nil {
+		return err
+	}
+	return out.Close()
+}
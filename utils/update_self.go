@@ -0,0 +1,222 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// checksumsAsset is the release manifest: `sha256sum` output for every binary.
+	checksumsAsset = "SHA256SUMS"
+
+	startCheckTimeout = 10 * time.Second
+)
+
+// SelfAssetName is the release asset built for this platform, e.g. iceslab_linux_amd64.
+func SelfAssetName() string {
+	return fmt.Sprintf("iceslab_%s_%s", runtime.GOOS, runtime.GOARCH)
+}
+
+// UpdateSelf replaces the installed binary with the channel's release for this platform.
+// The download is verified against the release's SHA256SUMS, written beside the
+// binary and renamed over it, so the binary is never missing or half-written. The
+// new binary's startup is then checked (see startCheck); if it fails, the previous
+// binary is put back.
+func (c *Client) UpdateSelf(channel string) error {
+	if _, err := os.Stat(paths.Binary); err != nil {
+		return fmt.Errorf("iceslab is not installed at %s: %w", paths.Binary, err)
+	}
+
+	resolution, err := c.ResolveBinaryChannel(channel)
+	if err != nil {
+		return err
+	}
+	if resolution.IsCommit {
+		return errBinaryPinnedToCommit
+	}
+	log.Info().Str("channel", resolution.Channel).Str("release", resolution.Ref).Msg("Resolved binary version")
+
+	asset := SelfAssetName()
+	sums, _, err := c.fetchIfChanged(c.url(resolution.releaseAssetPath(checksumsAsset)), "")
+	if err != nil {
+		return fmt.Errorf("failed to fetch release checksums: %w", err)
+	}
+	expected, ok := parseChecksums(sums)[asset]
+	if !ok {
+		return fmt.Errorf("release %s has no binary for %s/%s", resolution.Ref, runtime.GOOS, runtime.GOARCH)
+	}
+
+	current, err := HashFile(paths.Binary)
+	if err != nil {
+		return fmt.Errorf("failed to hash installed binary: %w", err)
+	}
+	if current == expected {
+		log.Info().Str("release", resolution.Ref).Str("hash", current).Msg("Binary is already up to date")
+		return nil
+	}
+	candidate := RolloutCandidate{Component: "binary", Version: resolution.Ref}
+	stationID := ""
+	if !resolution.isPinned() {
+		if resolution.Published != nil {
+			candidate.Published = *resolution.Published
+		}
+		stationID = ConfiguredStationID()
+		if c.HoldRollout(candidate, stationID) {
+			return nil
+		}
+	}
+	log.Info().Str("asset", asset).Str("installed_hash", current).Str("release_hash", expected).Msg("Downloading new binary")
+
+	binary, err := c.download(c.url(resolution.releaseAssetPath(asset)), "")
+	if err != nil {
+		return fmt.Errorf("failed to download %s: %w", asset, err)
+	}
+	defer binary.Close()
+	err = binary.verify(asset, expected)
+	if err != nil {
+		return err
+	}
+
+	previous, err := os.Open(paths.Binary)
+	if err != nil {
+		return fmt.Errorf("failed to read installed binary: %w", err)
+	}
+	_, err = writeFileFrom(paths.PreviousBinary, previous, 0755)
+	previous.Close()
+	if err != nil {
+		return fmt.Errorf("failed to keep previous binary: %w", err)
+	}
+	newPath := paths.Binary + ".new"
+	written, err := writeFileFrom(newPath, binary, 0755)
+	if err == nil && written != expected {
+		err = fmt.Errorf("%w for %s: got %s, expected %s", errChecksumMismatch, newPath, written, expected)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write new binary: %w", err)
+	}
+
+	if planEffect(EffectMove, newPath, "-> "+paths.Binary) {
+		planEffect(EffectExec, paths.Binary, strings.Join(startCheckArgs(), " "))
+		return nil
+	}
+	err = os.Rename(newPath, paths.Binary)
+	if err != nil {
+		_ = os.Remove(newPath)
+		return fmt.Errorf("failed to replace binary: %w", err)
+	}
+
+	output, err := startCheck(paths.Binary)
+	if !resolution.isPinned() {
+		c.ReportRollout(candidate, stationID, err)
+	}
+	if err != nil {
+		log.Error().Err(err).Str("output", output).Msg("New binary failed to start; rolling back")
+		rollbackErr := RollbackSelf()
+		if rollbackErr != nil {
+			return fmt.Errorf("new binary failed to start (%v) and rollback failed: %w", err, rollbackErr)
+		}
+		return fmt.Errorf("new binary failed to start; previous binary restored: %w", err)
+	}
+	err = RefreshRecordedHash(paths.Binary)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to update the install record for the new binary")
+	}
+	log.Info().Str("version", output).Str("path", paths.Binary).Msg("Binary updated")
+	return nil
+}
+
+// RollbackSelf puts back the binary that the last UpdateSelf replaced.
+func RollbackSelf() error {
+	if _, err := os.Stat(paths.PreviousBinary); err != nil {
+		return fmt.Errorf("no previous binary to roll back to: %w", err)
+	}
+	if planEffect(EffectMove, paths.PreviousBinary, "-> "+paths.Binary) {
+		return nil
+	}
+	err := os.Rename(paths.PreviousBinary, paths.Binary)
+	if err != nil {
+		return fmt.Errorf("failed to restore previous binary: %w", err)
+	}
+	err = RefreshRecordedHash(paths.Binary)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to update the install record for the restored binary")
+	}
+	log.Info().Str("path", paths.Binary).Msg("Previous binary restored")
+	return nil
+}
+
+// startCheck re-executes the new binary the way the next run will start it: the
+// same -root flag if this run had one, otherwise the same environment and config to
+// resolve the install root from. It goes through the binary's whole startup, root,
+// logging and command line included, into `update self -check-root`, which fails
+// unless it resolved this run's root and can load the config there (see CheckStart).
+// It returns the new binary's version.
+func startCheck(binary string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), startCheckTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, binary, startCheckArgs()...)
+	// Run from the install directory; the binary refuses to start inside a git checkout
+	cmd.Dir = paths.InstallDir
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if ctx.Err() != nil {
+		return stderr.String(), fmt.Errorf("timed out after %s", startCheckTimeout)
+	}
+	if err != nil {
+		return strings.TrimSpace(stdout.String() + stderr.String()), err
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+func startCheckArgs() []string {
+	args := []string{"update", "self", "-check-root", paths.Root}
+	if rootFromFlag {
+		args = append([]string{"-root", paths.Root}, args...)
+	}
+	return args
+}
+
+// CheckStart is the new binary's side of startCheck. Having started like any other
+// run, it fails unless it resolved root as the install root and can load the config
+// and, if there is one, the install record found there.
+func CheckStart(root string) error {
+	if paths.Root != root {
+		return fmt.Errorf("resolved install root %s, not %s: it would use another config", paths.Root, root)
+	}
+	_, err := LoadConfig()
+	if err != nil {
+		return err
+	}
+	_, err = LoadInstallRecord()
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// parseChecksums reads `sha256sum` output ("<hash>  <name>" per line) into name -> hash.
+func parseChecksums(data []byte) map[string]string {
+	sums := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		// A leading '*' marks binary mode in sha256sum output
+		sums[strings.TrimPrefix(fields[1], "*")] = strings.ToLower(fields[0])
+	}
+	return sums
+}
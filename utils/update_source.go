@@ -1,40 +1,71 @@
 package utils
 
 import (
+	"errors"
 	"fmt"
-	"io"
-	"net/http"
+
+	"github.com/rs/zerolog/log"
 )
 
-func (c *Client) UpdateSource() error {
-	zipData, err := c.DownloadSourceZip()
+// UpdateSource brings the source to the release or commit the channel resolves to:
+// only the changed files when the release publishes a source manifest, otherwise
+// the whole zipball.
+func (c *Client) UpdateSource(channel string) error {
+	resolution, err := c.ResolveBinaryChannel(channel)
 	if err != nil {
-		return fmt.Errorf("failed to download source zip: %w", err)
+		return err
 	}
+	log.Info().Str("channel", resolution.Channel).Str("ref", resolution.Ref).Msg("Resolved source version")
 
-	err = unzipInto("", zipData)
-	if err != nil {
-		return fmt.Errorf("failed to unzip source: %w", err)
+	err = c.updateSourceDelta(resolution)
+	if err == nil {
+		return writeFile(paths.SourceVersion, []byte(resolution.Ref+"\n"), 0644)
+	}
+	if errors.Is(err, errNoDelta) {
+		log.Info().Err(err).Msg("Downloading the full source zip")
+	} else {
+		log.Warn().Err(err).Msg("Delta update failed; downloading the full source zip")
 	}
 
-	return nil
-}
+	var verify func(dir string) error
+	manifest, err := c.sourceManifest(resolution)
+	switch {
+	case err == nil:
+		verify = func(dir string) error { return verifySource(dir, manifest) }
+	case errors.Is(err, errNotFound) && resolution.IsCommit:
+		// Pinning a commit is explicit, and commits publish no manifest to check against
+		log.Warn().Str("commit", resolution.Ref).Msg("Commits publish no source manifest; installing the source zip unverified")
+	case errors.Is(err, errNotFound):
+		err = allowUnverified(fmt.Sprintf("release %s publishes no source manifest", resolution.Ref))
+		if err != nil {
+			return err
+		}
+	default:
+		return err
+	}
 
-func (c *Client) DownloadSourceZip() ([]byte, error) {
-	response, err := c.http.Get(fmt.Sprintf("https://github.com/%s/%s/zipball/%s", owner, repo, branch))
+	zipball, err := c.DownloadSourceZip(resolution)
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("failed to download source zip: %w", err)
 	}
-	defer response.Body.Close()
+	defer zipball.Close()
 
-	if response.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("failed to download repo zip: status %d", response.StatusCode)
+	// The zipball's "<owner>-<repo>-<sha>/" root is dropped; paths.Source holds the tree itself
+	err = extractZipVerified(zipball, zipball.Size, paths.Source, 1, verify)
+	if err != nil {
+		return fmt.Errorf("failed to unzip source: %w", err)
 	}
 
-	zipData, err := io.ReadAll(response.Body)
+	return writeFile(paths.SourceVersion, []byte(resolution.Ref+"\n"), 0644)
+}
+
+// DownloadSourceZip downloads the zipball GitHub generates for the release or commit.
+// Zipballs are built on request, so there is no published checksum; UpdateSource
+// checks the unpacked tree against the source manifest instead.
+func (c *Client) DownloadSourceZip(resolution Resolution) (*downloadedFile, error) {
+	zipball, err := c.download(c.url(resolution.zipballPath()), "")
 	if err != nil {
-		return nil, fmt.Errorf("failed to read repo zip data: %w", err)
+		return nil, fmt.Errorf("failed to download repo zip: %w", err)
 	}
-
-	return zipData, nil
+	return zipball, nil
 }